@@ -2,7 +2,9 @@ package rtcnet
 
 import (
 	"errors"
+	"io"
 	"net"
+	"os"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -11,56 +13,345 @@ import (
 	"github.com/pion/webrtc/v4"
 )
 
+// The underlying transport that a connection sends its data over
+type Transport uint8
+
+const (
+	TransportWebRtc Transport = iota
+	TransportWebsocket
+)
+
+func (t Transport) String() string {
+	switch t {
+	case TransportWebRtc:
+		return "webrtc"
+	case TransportWebsocket:
+		return "websocket"
+	}
+	return "unknown"
+}
+
+// The type of a message. This lets text messages, such as those sent by browser code, be told apart from binary messages
+type MessageType uint8
+
+const (
+	MessageBinary MessageType = iota
+	MessageText
+)
+
+// A single message that was read off of the raw transport
+type message struct {
+	data []byte
+	isString bool
+}
+
 type Conn struct {
 	peerConn *webrtc.PeerConnection
 	dataChannel *webrtc.DataChannel
 	raw datachannel.ReadWriteCloser
+	transport Transport
+
+	channelsMux sync.Mutex
+	channels map[string]*Conn // Additional data channels that were opened on the same peer connection
+
+	fragment atomic.Bool // If true, then messages are fragmented and reassembled so that they can be larger than the max message size
+	writeMux sync.Mutex
 
-	// readChan chan []byte
+	stream bool // If true, then reads and writes have byte stream semantics instead of message semantics
+	streamMux sync.Mutex
+	streamWriteMux sync.Mutex // Held for a whole stream write, so that the chunks of concurrent writes never interleave
+	streamBuf []byte // In stream mode, the unread remainder of the last message
+
+	readChan chan message // Messages that the readLoop has pulled off of the raw transport
+	readErr error // The error that stopped the readLoop. Only valid once readChan is closed
 	errorChan chan error
 
+	readDeadline *deadline
+	writeDeadline *deadline
+
 	closeOnce sync.Once
 	closed atomic.Bool
+	closeChan chan struct{}
 
 	localAddr, remoteAddr net.Addr
+	packetAddr *PeerAddr // The address of the peer in the listener packet conn, see PacketAddr
+	metadata *Metadata
+	helloReply []byte
+	subprotocol string
 }
 func newConn(peer *webrtc.PeerConnection, localAddr, remoteAddr net.Addr) *Conn {
 	c := &Conn{
 		peerConn: peer,
+		channels: make(map[string]*Conn),
+		readChan: make(chan message),
 		errorChan: make(chan error, 16), //TODO! - Sizing
 
+		readDeadline: newDeadline(),
+		writeDeadline: newDeadline(),
+		closeChan: make(chan struct{}),
+
 		localAddr: localAddr,
 		remoteAddr: remoteAddr,
 	}
 	return c
 }
 
+// Sets the raw transport of the connection and starts reading from it
+func (c *Conn) setRaw(raw datachannel.ReadWriteCloser) {
+	c.raw = raw
+	go c.readLoop()
+}
+
+// Adds an additional data channel to the connection. The channel shares the peer connection of this conn, so only closes its own data channel when closed
+func (c *Conn) addChannel(d *webrtc.DataChannel, raw datachannel.ReadWriteCloser) {
+	channel := newConn(nil, c.localAddr, c.remoteAddr)
+	channel.metadata = c.metadata
+	channel.dataChannel = d
+	channel.setRaw(raw)
+
+	c.channelsMux.Lock()
+	c.channels[d.Label()] = channel
+	c.channelsMux.Unlock()
+}
+
+// Returns the additional data channel with the label, or nil if no channel with that label was opened. Connections that use the websocket fallback never have additional channels
+func (c *Conn) Channel(label string) *Conn {
+	c.channelsMux.Lock()
+	defer c.channelsMux.Unlock()
+	return c.channels[label]
+}
+
+// Returns the number of additional data channels that are open
+func (c *Conn) numChannels() int {
+	c.channelsMux.Lock()
+	defer c.channelsMux.Unlock()
+	return len(c.channels)
+}
+
+// Continually reads messages off of the raw transport and pushes them into the read channel. This lets reads be interrupted by deadlines without disturbing the underlying transport
+func (c *Conn) readLoop() {
+	buf := make([]byte, maxMessageSize)
+	var fragments reassembler
+	for {
+		n, isString, err := c.raw.ReadDataChannel(buf)
+		if errors.Is(err, io.ErrShortBuffer) {
+			// Note: The transport has already dropped the message, so just skip it
+			logger.Warn().Msg("conn: dropped message larger than max message size")
+			continue
+		}
+		if err != nil {
+			c.readErr = err
+			close(c.readChan)
+			return
+		}
+
+		msg := message{
+			isString: isString,
+		}
+		if c.fragment.Load() {
+			data, done, err := fragments.add(buf[:n])
+			if err != nil {
+				c.readErr = err
+				close(c.readChan)
+				return
+			}
+			if !done {
+				continue
+			}
+			msg.data = data
+		} else {
+			msg.data = make([]byte, n)
+			copy(msg.data, buf[:n])
+		}
+
+		select {
+		case c.readChan <- msg:
+		case <-c.closeChan:
+			return
+		}
+	}
+}
+
 // For pushing error data out of the webrtc connection into the error buffer
 func (c *Conn) pushErrorData(err error) {
 	if c.closed.Load() { return } // Skip if we are already closed
 
-	c.errorChan <- err
+	select {
+	case c.errorChan <- err:
+	default:
+		// Note: If the error buffer is full, then there is already an error waiting to be read
+	}
 }
 
 
+// Reads the next message into b. If b is too small to hold the message, then the message is dropped and io.ErrShortBuffer is returned. Use ReadMessage to avoid this.
+// In stream mode, any unread remainder of the message is buffered and returned by the next reads instead
 func (c *Conn) Read(b []byte) (int, error) {
+	if c.stream {
+		return c.readStream(b)
+	}
+
+	msg, err := c.readMessage()
+	if err != nil {
+		return 0, err
+	}
+	// Note: Matches data channel behavior, where the message is dropped if the buffer is too small
+	if len(msg.data) > len(b) {
+		return 0, io.ErrShortBuffer
+	}
+	return copy(b, msg.data), nil
+}
+
+// Writes b as a single binary message. In stream mode, b is split into as many messages as needed
+func (c *Conn) Write(b []byte) (int, error) {
+	if c.stream {
+		return c.writeStream(b)
+	}
+	return c.writeMessage(b, false)
+}
+
+// The largest message that stream mode writes. This is small enough to be sent by every browser
+const streamChunkSize = 16 * 1024
+
+func (c *Conn) readStream(b []byte) (int, error) {
+	c.streamMux.Lock()
+	defer c.streamMux.Unlock()
+
+	// Note: Skip empty messages, so that we never return 0 bytes without an error
+	for len(c.streamBuf) == 0 && len(b) > 0 {
+		msg, err := c.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		c.streamBuf = msg.data
+	}
+
+	n := copy(b, c.streamBuf)
+	c.streamBuf = c.streamBuf[n:]
+	return n, nil
+}
+
+func (c *Conn) writeStream(b []byte) (int, error) {
+	c.streamWriteMux.Lock()
+	defer c.streamWriteMux.Unlock()
+
+	total := 0
+	for len(b) > 0 {
+		chunk := b[:min(len(b), streamChunkSize)]
+		n, err := c.writeMessage(chunk, false)
+		total += n
+		if err != nil {
+			return total, err
+		}
+		b = b[len(chunk):]
+	}
+	return total, nil
+}
+
+// Reads the next whole message, regardless of whether it is binary or text. Every message written by the other side is read exactly once, with the same boundaries. This should not be mixed with Read in stream mode
+func (c *Conn) ReadMessage() ([]byte, error) {
+	msg, err := c.readMessage()
+	if err != nil {
+		return nil, err
+	}
+	return msg.data, nil
+}
+
+// Reads the next whole message along with its type
+func (c *Conn) ReadTypedMessage() (MessageType, []byte, error) {
+	msg, err := c.readMessage()
+	if err != nil {
+		return MessageBinary, nil, err
+	}
+	if msg.isString {
+		return MessageText, msg.data, nil
+	}
+	return MessageBinary, msg.data, nil
+}
+
+// Writes b as a single binary message
+func (c *Conn) WriteMessage(b []byte) error {
+	_, err := c.writeMessage(b, false)
+	return err
+}
+
+// Writes b as a single message of the given type
+func (c *Conn) WriteTypedMessage(typ MessageType, b []byte) error {
+	_, err := c.writeMessage(b, typ == MessageText)
+	return err
+}
+
+func (c *Conn) readMessage() (message, error) {
 	select {
 	case err := <-c.errorChan:
-		return 0, err // There was some error
+		return message{}, err // There was some error
 	default:
 		// Just exit
 	}
-	return c.raw.Read(b)
+
+	if c.closed.Load() {
+		return message{}, net.ErrClosed
+	}
+	if isDone(c.readDeadline.wait()) {
+		return message{}, os.ErrDeadlineExceeded
+	}
+
+	select {
+	case msg, ok := <-c.readChan:
+		if !ok {
+			return message{}, c.readErr
+		}
+		return msg, nil
+	case err := <-c.errorChan:
+		return message{}, err
+	case <-c.readDeadline.wait():
+		return message{}, os.ErrDeadlineExceeded
+	case <-c.closeChan:
+		return message{}, net.ErrClosed
+	}
 }
 
-func (c *Conn) Write(b []byte) (int, error) {
+func (c *Conn) writeMessage(b []byte, isString bool) (int, error) {
 	select {
 	case err := <-c.errorChan:
 		return 0, err // There was some error
 	default:
 		// Just exit
 	}
-	return c.raw.Write(b)
+
+	if c.closed.Load() {
+		return 0, net.ErrClosed
+	}
+	if isDone(c.writeDeadline.wait()) {
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	if c.fragment.Load() {
+		// Note: Fragments of concurrent writes must not be interleaved
+		c.writeMux.Lock()
+		defer c.writeMux.Unlock()
+		err := writeFragments(b, c.fragmentSize(), func(fragment []byte) error {
+			_, err := c.raw.WriteDataChannel(fragment, isString)
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	return c.raw.WriteDataChannel(b, isString)
+}
+
+// Returns the largest fragment, including its header, that can be written as a single message
+func (c *Conn) fragmentSize() int {
+	size := maxMessageSize
+	if c.peerConn != nil {
+		negotiated := remoteMaxMessageSize(c.peerConn)
+		if negotiated > 0 && negotiated < size {
+			size = negotiated
+		}
+	}
+	return size
 }
 
 func (c *Conn) Close() error {
@@ -68,6 +359,13 @@ func (c *Conn) Close() error {
 	c.closeOnce.Do(func() {
 		trace("conn: closing: ")
 		c.closed.Store(true)
+		close(c.closeChan)
+
+		c.channelsMux.Lock()
+		for _, channel := range c.channels {
+			channel.Close()
+		}
+		c.channelsMux.Unlock()
 
 		var err1, err2, err3 error
 		if c.dataChannel != nil {
@@ -80,8 +378,6 @@ func (c *Conn) Close() error {
 			err3 = c.raw.Close()
 		}
 
-		close(c.errorChan)
-
 		if err1 != nil || err2 != nil || err3 != nil {
 			closeErr = errors.Join(errors.New("failed to close: (datachannel, peerconn, raw)"), err1, err2, err3)
 			logger.Error().
@@ -92,6 +388,34 @@ func (c *Conn) Close() error {
 	return closeErr
 }
 
+// Returns the transport that this connection sends its data over. Useful for measuring how many connections had to use the websocket fallback
+func (c *Conn) Transport() Transport {
+	return c.transport
+}
+
+// Returns information about the request that this connection was accepted from. This is nil on the dialing side
+func (c *Conn) Metadata() *Metadata {
+	return c.metadata
+}
+
+// Returns the identity that ListenConfig.Authenticate returned for this connection. This is nil on the dialing side, or if the listener has no auth hook
+func (c *Conn) Identity() any {
+	if c.metadata == nil {
+		return nil
+	}
+	return c.metadata.Identity
+}
+
+// Returns the websocket subprotocol that was negotiated from DialConfig.Subprotocols and ListenConfig.Subprotocols, or "" if there is none. For webrtc conns this is the subprotocol of the signalling websocket
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// Returns the payload that the listener replied to DialConfig.Hello with. This is nil on the listening side, or if no hello was sent
+func (c *Conn) HelloReply() []byte {
+	return c.helloReply
+}
+
 func (c *Conn) LocalAddr() net.Addr {
 	return c.localAddr
 }
@@ -100,17 +424,93 @@ func (c *Conn) RemoteAddr() net.Addr {
 	return c.remoteAddr
 }
 
+// Sets the read and write deadlines. Pending reads and writes are unblocked with os.ErrDeadlineExceeded once the deadline passes. A zero value disables the deadline
 func (c *Conn) SetDeadline(t time.Time) error {
-	//TODO: implement
-	return nil
+	err1 := c.SetReadDeadline(t)
+	err2 := c.SetWriteDeadline(t)
+	return errors.Join(err1, err2)
 }
 
 func (c *Conn) SetReadDeadline(t time.Time) error {
-	//TODO: implement
+	if c.closed.Load() {
+		return net.ErrClosed
+	}
+	c.readDeadline.set(t)
 	return nil
 }
 
 func (c *Conn) SetWriteDeadline(t time.Time) error {
-	//TODO: implement
+	if c.closed.Load() {
+		return net.ErrClosed
+	}
+	c.writeDeadline.set(t)
+
+	// Note: Data channel writes never block, but websocket writes can, so let the transport interrupt them too
+	if wd, ok := c.raw.(datachannel.WriteDeadliner); ok {
+		return wd.SetWriteDeadline(t)
+	}
 	return nil
 }
+
+// --------------------------------------------------------------------------------
+// - Deadlines
+// --------------------------------------------------------------------------------
+// Tracks a read or write deadline. The channel returned by wait is closed once the deadline has passed. Based on the deadline implementation of net.Pipe
+type deadline struct {
+	mu sync.Mutex
+	timer *time.Timer
+	cancel chan struct{}
+}
+
+func newDeadline() *deadline {
+	return &deadline{cancel: make(chan struct{})}
+}
+
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // Wait for the timer callback to finish and close the channel
+	}
+	d.timer = nil
+
+	closed := isDone(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() {
+			close(cancel)
+		})
+		return
+	}
+
+	// The deadline has already passed
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isDone(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
@@ -1,7 +1,19 @@
 package rtcnet
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"runtime"
 	"net"
@@ -9,6 +21,10 @@ import (
 	"crypto/tls"
 	"time"
 	"math/rand"
+
+	"github.com/coder/websocket"
+	"github.com/pion/turn/v4"
+	"github.com/pion/webrtc/v4"
 )
 
 // Helper functions
@@ -98,7 +114,7 @@ func TestConn(t *testing.T) {
 	{
 		conn, err := Dial("localhost:2000", &tls.Config{
 			InsecureSkipVerify: true,
-		})
+		}, true, nil)
 		if err != nil {
 			t.Errorf("%v", err)
 		}
@@ -133,9 +149,2019 @@ func TestConn(t *testing.T) {
 		fmt.Println("Success: ", successCount)
 		err = conn.Close()
 		if err != nil {
-			fmt.Errorf("%v", err)
+			t.Errorf("%v", err)
 		}
 	}
 
 	fmt.Println("Done")
 }
+
+func TestDialContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	start := time.Now()
+	_, err := DialContext(ctx, "localhost:2001", DialConfig{
+		TlsConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+	})
+	check(t, err != nil)
+	check(t, time.Since(start) < 1 * time.Second)
+}
+
+// Starts an echo server on the address
+func listenEcho(t *testing.T, address string, config ListenConfig) *Listener {
+	if config.TlsConfig == nil {
+		config.TlsConfig = tlsConfig()
+	}
+	l, err := NewListener(address, config)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				io.Copy(c, c)
+				c.Close()
+			}(conn)
+		}
+	}()
+	return l
+}
+
+// Starts a listener that sends every conn that it accepts to the returned channel, so that the test can check the accepted side. The listener is closed when the test finishes
+func listenAccept(t *testing.T, address string, config ListenConfig) (*Listener, chan *Conn) {
+	if config.TlsConfig == nil {
+		config.TlsConfig = tlsConfig()
+	}
+	l, err := NewListener(address, config)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	accepted := make(chan *Conn, 16)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn.(*Conn)
+		}
+	}()
+	return l, accepted
+}
+
+// Waits for the next conn that the listener accepts
+func nextAccepted(t *testing.T, accepted chan *Conn) *Conn {
+	select {
+	case conn := <-accepted:
+		return conn
+	case <-time.After(10 * time.Second):
+		t.Fatalf("no conn was accepted")
+		return nil
+	}
+}
+
+// Returns the ICE candidate pair that the webrtc conn is connected over
+func selectedPair(t *testing.T, conn *Conn) *webrtc.ICECandidatePair {
+	pair, err := conn.peerConn.SCTP().Transport().ICETransport().GetSelectedCandidatePair()
+	if err != nil || pair == nil {
+		t.Fatalf("no selected candidate pair: %v", err)
+	}
+	return pair
+}
+
+// Writes random data to the conn and checks that it is echoed back
+func checkEcho(t *testing.T, conn net.Conn, numIterations int) {
+	for iter := 0; iter < numIterations; iter++ {
+		dat := randomSlice(rand.Intn(4*1024) + 1)
+		n1, err := conn.Write(dat)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		buf := make([]byte, len(dat))
+		n2, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		compare(t, n2, n1)
+		for i := range buf {
+			compare(t, buf[i], dat[i])
+		}
+	}
+}
+
+func TestDialWebsocketFallback(t *testing.T) {
+	listenEcho(t, "localhost:2002", ListenConfig{
+		OriginPatterns: []string{"localhost", "localhost:2002"},
+	})
+
+	conn, err := DialContext(context.Background(), "localhost:2002", DialConfig{
+		TlsConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+		Mode: DialWebsocket,
+		Timeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer conn.Close()
+
+	compare(t, conn.Transport(), TransportWebsocket)
+	checkEcho(t, conn, 100)
+}
+
+func TestDialRace(t *testing.T) {
+	listenEcho(t, "localhost:2003", ListenConfig{
+		OriginPatterns: []string{"localhost", "localhost:2003"},
+	})
+
+	// Note: With a long head start, webrtc should always win on localhost
+	conn, err := DialContext(context.Background(), "localhost:2003", DialConfig{
+		TlsConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+		Ordered: true,
+		Mode: DialRace,
+		Timeout: 10 * time.Second,
+		FallbackDelay: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer conn.Close()
+
+	compare(t, conn.Transport(), TransportWebRtc)
+	checkEcho(t, conn, 100)
+}
+
+// Counts the conns of a net.Listener that are still open on both ends. A conn stops counting once it is closed, or once a read fails because the peer closed it
+type trackingListener struct {
+	net.Listener
+	open atomic.Int32
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.open.Add(1)
+	return &trackingConn{Conn: conn, listener: l}, nil
+}
+
+type trackingConn struct {
+	net.Conn
+	listener *trackingListener
+	once sync.Once
+}
+
+func (c *trackingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+		c.once.Do(func() { c.listener.open.Add(-1) })
+	}
+	return n, err
+}
+
+func (c *trackingConn) Close() error {
+	c.once.Do(func() { c.listener.open.Add(-1) })
+	return c.Conn.Close()
+}
+
+// Waits for the number of open conns of the listener to reach n
+func waitOpen(t *testing.T, l *trackingListener, n int32) {
+	deadline := time.Now().Add(5 * time.Second)
+	for l.open.Load() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d open conns, got %d", n, l.open.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDialRaceFallback(t *testing.T) {
+	release := make(chan struct{})
+	l, err := NewHandler(ListenConfig{
+		Hello: func(metadata *Metadata, payload []byte) ([]byte, bool) {
+			if string(payload) == "stall" {
+				<-release
+			}
+			return nil, true
+		},
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				io.Copy(c, c)
+				c.Close()
+			}(conn)
+		}
+	}()
+
+	// Note: The conns are tracked above TLS, because a dialer that closes its conn sends a close_notify, which ends the TLS conn before the TCP conn
+	server := httptest.NewUnstartedServer(l)
+	tracker := &trackingListener{Listener: tls.NewListener(server.Listener, tlsConfig())}
+	server.Listener = tracker
+	server.Start()
+	defer server.Close()
+	address := strings.TrimPrefix(server.URL, "http://")
+
+	// Note: With a relay only policy and no TURN server, ICE can never finish, so the websocket has to win
+	config := DialConfig{
+		TlsConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+		Ordered: true,
+		Mode: DialRace,
+		Timeout: 10 * time.Second,
+		FallbackDelay: 100 * time.Millisecond,
+		Network: NetworkConfig{
+			IceTransportPolicy: webrtc.ICETransportPolicyRelay,
+		},
+	}
+	conn, err := DialContext(context.Background(), address, config)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	compare(t, conn.Transport(), TransportWebsocket)
+	checkEcho(t, conn, 100)
+
+	// The losing webrtc dial is torn down, so the listener only keeps the websocket of the winner open
+	waitOpen(t, tracker, 1)
+	conn.Close()
+	waitOpen(t, tracker, 0)
+
+	// Cancelling the race while both dials are waiting for their hello replies tears down both of them
+	config.Hello = []byte("stall")
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(500 * time.Millisecond, cancel)
+	_, err = DialContext(ctx, address, config)
+	check(t, errors.Is(err, context.Canceled))
+	close(release)
+	waitOpen(t, tracker, 0)
+}
+
+func TestConnDeadline(t *testing.T) {
+	listenEcho(t, "localhost:2004", ListenConfig{
+		OriginPatterns: []string{"localhost", "localhost:2004"},
+	})
+
+	for _, mode := range []DialMode{DialWebRtc, DialWebsocket} {
+		conn, err := DialContext(context.Background(), "localhost:2004", DialConfig{
+			TlsConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+			Ordered: true,
+			Mode: mode,
+			Timeout: 10 * time.Second,
+		})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		// Nothing is being echoed, so the read should time out
+		err = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		check(t, err == nil)
+		buf := make([]byte, 1024)
+		_, err = conn.Read(buf)
+		check(t, errors.Is(err, os.ErrDeadlineExceeded))
+		netErr, ok := err.(net.Error)
+		check(t, ok && netErr.Timeout())
+
+		// Clearing the deadline should make the conn usable again
+		err = conn.SetReadDeadline(time.Time{})
+		check(t, err == nil)
+		checkEcho(t, conn, 10)
+
+		// A deadline in the past should immediately fail writes
+		err = conn.SetWriteDeadline(time.Now().Add(-1 * time.Second))
+		check(t, err == nil)
+		_, err = conn.Write([]byte("hello"))
+		check(t, errors.Is(err, os.ErrDeadlineExceeded))
+
+		conn.Close()
+	}
+}
+
+func TestMultipleChannels(t *testing.T) {
+	l, err := NewListener("localhost:2005", ListenConfig{
+		TlsConfig: tlsConfig(),
+		OriginPatterns: []string{"localhost", "localhost:2005"},
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		rtcConn := conn.(*Conn)
+		for _, c := range []net.Conn{rtcConn, rtcConn.Channel("chat"), rtcConn.Channel("state")} {
+			if c == nil {
+				t.Errorf("missing channel on accepted conn")
+				return
+			}
+			go io.Copy(c, c)
+		}
+	}()
+
+	maxRetransmits := uint16(0)
+	conn, err := DialContext(context.Background(), "localhost:2005", DialConfig{
+		TlsConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+		Ordered: true,
+		Timeout: 10 * time.Second,
+		Channels: []ChannelConfig{
+			{Label: "chat", Ordered: true},
+			{Label: "state", Ordered: false, MaxRetransmits: &maxRetransmits},
+		},
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer conn.Close()
+
+	check(t, conn.Channel("missing") == nil)
+	chat := conn.Channel("chat")
+	state := conn.Channel("state")
+	check(t, chat != nil && state != nil)
+	compare(t, state.dataChannel.Ordered(), false)
+	compare(t, *state.dataChannel.MaxRetransmits(), uint16(0))
+
+	checkEcho(t, conn, 10)
+	checkEcho(t, chat, 10)
+	checkEcho(t, state, 10) // Note: Lossless on localhost
+}
+
+// Starts a server that echos every message back with the same type
+func listenMessageEcho(t *testing.T, address string) *Listener {
+	l, err := NewListener(address, ListenConfig{
+		TlsConfig: tlsConfig(),
+		OriginPatterns: []string{"localhost", address},
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil || conn == nil {
+				return
+			}
+			go func(c *Conn) {
+				defer c.Close()
+				for {
+					typ, dat, err := c.ReadTypedMessage()
+					if err != nil {
+						return
+					}
+					err = c.WriteTypedMessage(typ, dat)
+					if err != nil {
+						return
+					}
+				}
+			}(conn.(*Conn))
+		}
+	}()
+	return l
+}
+
+func TestConnMessages(t *testing.T) {
+	l := listenMessageEcho(t, "localhost:2006")
+	defer l.Close()
+
+	for _, mode := range []DialMode{DialWebRtc, DialWebsocket} {
+		conn, err := DialContext(context.Background(), "localhost:2006", DialConfig{
+			TlsConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+			Ordered: true,
+			Mode: mode,
+			Timeout: 10 * time.Second,
+		})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		// Write a burst of messages before reading, so that boundaries would be lost if they weren't preserved
+		sent := make([][]byte, 0)
+		for i := 0; i < 50; i++ {
+			dat := randomSlice(rand.Intn(4*1024) + 1)
+			err := conn.WriteMessage(dat)
+			check(t, err == nil)
+			sent = append(sent, dat)
+		}
+		for _, dat := range sent {
+			typ, msg, err := conn.ReadTypedMessage()
+			check(t, err == nil)
+			compare(t, typ, MessageBinary)
+			compare(t, string(msg), string(dat))
+		}
+
+		err = conn.WriteTypedMessage(MessageText, []byte("hello"))
+		check(t, err == nil)
+		typ, msg, err := conn.ReadTypedMessage()
+		check(t, err == nil)
+		compare(t, typ, MessageText)
+		compare(t, string(msg), "hello")
+
+		conn.Close()
+	}
+}
+
+func TestConnStream(t *testing.T) {
+	listenEcho(t, "localhost:2007", ListenConfig{
+		OriginPatterns: []string{"localhost", "localhost:2007"},
+		Stream: true,
+	})
+
+	for _, mode := range []DialMode{DialWebRtc, DialWebsocket} {
+		conn, err := DialContext(context.Background(), "localhost:2007", DialConfig{
+			TlsConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+			Ordered: true,
+			Mode: mode,
+			Timeout: 10 * time.Second,
+			Stream: true,
+		})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		// Write more than a single chunk, then read it back with small reads
+		dat := randomSlice(200 * 1024)
+		go func() {
+			n, err := conn.Write(dat)
+			check(t, err == nil)
+			compare(t, n, len(dat))
+		}()
+
+		buf := make([]byte, 0, len(dat))
+		small := make([]byte, 100)
+		for len(buf) < len(dat) {
+			n, err := conn.Read(small)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			buf = append(buf, small[:n]...)
+		}
+		compare(t, string(buf), string(dat))
+
+		// Concurrent writes are never interleaved
+		writeSize := 256 * 1024
+		numWriters := 4
+		for w := 0; w < numWriters; w++ {
+			go func(dat []byte) {
+				_, err := conn.Write(dat)
+				check(t, err == nil)
+			}(bytes.Repeat([]byte{byte(w)}, writeSize))
+		}
+		buf = make([]byte, writeSize * numWriters)
+		_, err = io.ReadFull(conn, buf)
+		check(t, err == nil)
+		for i := range buf {
+			if buf[i] != buf[i / writeSize * writeSize] {
+				t.Fatalf("stream writes were interleaved at byte %d", i)
+			}
+		}
+
+		conn.Close()
+	}
+
+	// Stream mode can't be used on a primary channel that can lose or reorder bytes
+	_, err := DialContext(context.Background(), "localhost:2007", DialConfig{
+		TlsConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+		Timeout: 10 * time.Second,
+		Stream: true,
+	})
+	check(t, errors.Is(err, errStreamUnreliable))
+
+	// A stream listener rejects dialers like that too, without returning an error from Accept
+	_, err = DialContext(context.Background(), "localhost:2007", DialConfig{
+		TlsConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+		Timeout: 2 * time.Second,
+	})
+	check(t, err != nil)
+
+	conn, err := DialContext(context.Background(), "localhost:2007", DialConfig{
+		TlsConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+		Ordered: true,
+		Timeout: 10 * time.Second,
+		Stream: true,
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	checkEcho(t, conn, 10)
+	conn.Close()
+}
+
+func TestConnFragmentation(t *testing.T) {
+	l := listenMessageEcho(t, "localhost:2008")
+	defer l.Close()
+
+	for _, mode := range []DialMode{DialWebRtc, DialWebsocket} {
+		conn, err := DialContext(context.Background(), "localhost:2008", DialConfig{
+			TlsConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+			Ordered: true,
+			Mode: mode,
+			Timeout: 10 * time.Second,
+		})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		check(t, conn.fragment.Load())
+
+		for _, size := range []int{0, 1, maxMessageSize - 1, maxMessageSize, 3 * maxMessageSize + 7, 1024 * 1024} {
+			dat := randomSlice(size)
+			err := conn.WriteMessage(dat)
+			check(t, err == nil)
+
+			msg, err := conn.ReadMessage()
+			check(t, err == nil)
+			compare(t, len(msg), len(dat))
+			compare(t, string(msg), string(dat))
+		}
+
+		conn.Close()
+	}
+}
+
+func TestPacketConn(t *testing.T) {
+	l := listenEcho(t, "localhost:2009", ListenConfig{
+		OriginPatterns: []string{"localhost", "localhost:2009"},
+	})
+	defer l.Close()
+
+	// Echo every packet back to the peer that sent it
+	go func() {
+		pc := l.PacketConn()
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	conn, err := DialContext(context.Background(), "localhost:2009", DialConfig{
+		TlsConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+		Ordered: true,
+		Timeout: 10 * time.Second,
+		PacketChannel: true,
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer conn.Close()
+
+	pc := conn.PacketConn()
+	check(t, pc != nil)
+	compare(t, conn.Channel(packetChannelLabel).dataChannel.Ordered(), false)
+
+	// Note: The channel is unreliable, but packets shouldn't be dropped on localhost
+	buf := make([]byte, 2048)
+	for i := 0; i < 10; i++ {
+		dat := randomSlice(rand.Intn(1024) + 1)
+		_, err := pc.WriteTo(dat, conn.RemoteAddr())
+		check(t, err == nil)
+
+		pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		compare(t, addr.String(), conn.RemoteAddr().String())
+		compare(t, string(buf[:n]), string(dat))
+	}
+
+	// The primary channel still works alongside the packet channel
+	checkEcho(t, conn, 10)
+
+	_, err = l.PacketConn().WriteTo([]byte("hello"), wsAddr("unknown"))
+	check(t, errors.Is(err, ErrUnknownPeer))
+}
+
+// A raw transport that is backed by channels, so that a conn can be tested without a real peer
+type chanRaw struct {
+	reads chan []byte
+	writes chan []byte
+	closeOnce sync.Once
+	closed chan struct{}
+}
+
+func newChanRaw() *chanRaw {
+	return &chanRaw{
+		reads: make(chan []byte, 16),
+		writes: make(chan []byte, 16),
+		closed: make(chan struct{}),
+	}
+}
+
+func (r *chanRaw) Read(b []byte) (int, error) {
+	n, _, err := r.ReadDataChannel(b)
+	return n, err
+}
+
+func (r *chanRaw) ReadDataChannel(b []byte) (int, bool, error) {
+	select {
+	case dat := <-r.reads:
+		return copy(b, dat), false, nil
+	case <-r.closed:
+		return 0, false, io.EOF
+	}
+}
+
+func (r *chanRaw) Write(b []byte) (int, error) {
+	return r.WriteDataChannel(b, false)
+}
+
+func (r *chanRaw) WriteDataChannel(b []byte, isString bool) (int, error) {
+	select {
+	case r.writes <- append([]byte(nil), b...):
+		return len(b), nil
+	case <-r.closed:
+		return 0, io.ErrClosedPipe
+	}
+}
+
+func (r *chanRaw) Close() error {
+	r.closeOnce.Do(func() { close(r.closed) })
+	return nil
+}
+
+func TestPacketConnPeerAddrs(t *testing.T) {
+	pc := newListenerPacketConn(wsAddr("listener"))
+	defer pc.Close()
+
+	// Note: Both peers were signalled over the same connection, so they have the same remote address
+	remote := wsAddr("proxy:443")
+	raws := []*chanRaw{newChanRaw(), newChanRaw()}
+	addrs := make([]net.Addr, len(raws))
+	for i, raw := range raws {
+		channel := newConn(nil, wsAddr("listener"), remote)
+		channel.setRaw(raw)
+		defer channel.Close()
+		addrs[i] = pc.addPeer(channel)
+	}
+	check(t, addrs[0] != addrs[1])
+
+	buf := make([]byte, 100)
+	for i, raw := range raws {
+		raw.reads <- []byte{byte(i)}
+		pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, addr, err := pc.ReadFrom(buf)
+		check(t, err == nil)
+		compare(t, string(buf[:n]), string([]byte{byte(i)}))
+		compare(t, addr, addrs[i])
+	}
+
+	// Replies go to the peer that sent the packet
+	for i, raw := range raws {
+		_, err := pc.WriteTo([]byte{byte(i)}, addrs[i])
+		check(t, err == nil)
+		compare(t, string(<-raw.writes), string([]byte{byte(i)}))
+	}
+
+	_, err := pc.WriteTo([]byte("hello"), remote)
+	check(t, errors.Is(err, ErrUnknownPeer))
+}
+
+func TestPacketConnTruncate(t *testing.T) {
+	raws := []*chanRaw{newChanRaw(), newChanRaw()}
+	channels := make([]*Conn, len(raws))
+	for i, raw := range raws {
+		channels[i] = newConn(nil, wsAddr("local"), wsAddr("remote"))
+		channels[i].setRaw(raw)
+		defer channels[i].Close()
+	}
+
+	listenerPc := newListenerPacketConn(wsAddr("local"))
+	defer listenerPc.Close()
+	listenerPc.addPeer(channels[1])
+	pcs := []net.PacketConn{&peerPacketConn{channels[0]}, listenerPc}
+
+	// Packets that don't fit in the buffer are truncated, and the remainder is discarded
+	buf := make([]byte, 5)
+	for i, pc := range pcs {
+		raws[i].reads <- []byte("hello world")
+		raws[i].reads <- []byte("next")
+		pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		n, _, err := pc.ReadFrom(buf)
+		check(t, err == nil)
+		compare(t, string(buf[:n]), "hello")
+		n, _, err = pc.ReadFrom(buf)
+		check(t, err == nil)
+		compare(t, string(buf[:n]), "next")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	l, err := NewHandler(ListenConfig{})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer l.Close()
+
+	// Mux addresses that can't be listened on fail straight away, instead of failing every negotiation
+	_, err = NewHandler(ListenConfig{UdpMuxAddress: "not-an-address"})
+	check(t, err != nil)
+
+	mux := http.NewServeMux()
+	mux.Handle("/rtc/", http.StripPrefix("/rtc", l))
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	server := httptest.NewUnstartedServer(mux)
+	server.TLS = tlsConfig()
+	server.StartTLS()
+	defer server.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				io.Copy(c, c)
+				c.Close()
+			}(conn)
+		}
+	}()
+
+	address := strings.TrimPrefix(server.URL, "https://") + "/rtc/"
+	for _, mode := range []DialMode{DialWebRtc, DialWebsocket} {
+		conn, err := DialContext(context.Background(), address, DialConfig{
+			TlsConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+			Ordered: true,
+			Mode: mode,
+			Timeout: 10 * time.Second,
+		})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		checkEcho(t, conn, 10)
+		conn.Close()
+	}
+
+	// The rest of the server still works
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	resp, err := client.Get(server.URL + "/health")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	compare(t, string(body), "ok")
+}
+
+func TestPlaintext(t *testing.T) {
+	l := listenEcho(t, "localhost:2011", ListenConfig{
+		OriginPatterns: []string{"localhost", "localhost:2011"},
+		Plaintext: true,
+	})
+	defer l.Close()
+
+	for _, mode := range []DialMode{DialWebRtc, DialWebsocket} {
+		conn, err := DialContext(context.Background(), "localhost:2011", DialConfig{
+			Plaintext: true,
+			Ordered: true,
+			Mode: mode,
+			Timeout: 10 * time.Second,
+		})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		checkEcho(t, conn, 10)
+		conn.Close()
+	}
+
+	// Dialing with TLS against a plaintext listener should fail
+	_, err := DialContext(context.Background(), "localhost:2011", DialConfig{
+		TlsConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+		Timeout: 2 * time.Second,
+	})
+	check(t, err != nil)
+}
+
+func TestWebsocketUrl(t *testing.T) {
+	tests := []struct {
+		address, suffix string
+		plaintext bool
+		expected string
+	}{
+		{"localhost:2000", "", false, "wss://localhost:2000"},
+		{"localhost:2000", "/wss", true, "ws://localhost:2000/wss"},
+		{"example.com/realm/eu-1/", "/wss", false, "wss://example.com/realm/eu-1/wss"},
+		{"wss://example.com/realm/eu-1?ticket=abc", "", false, "wss://example.com/realm/eu-1?ticket=abc"},
+		{"wss://example.com/realm/eu-1?ticket=abc", "/wss", false, "wss://example.com/realm/eu-1/wss?ticket=abc"},
+		{"https://example.com/realm", "", false, "wss://example.com/realm"},
+		{"http://example.com/realm", "", false, "ws://example.com/realm"},
+	}
+	for _, test := range tests {
+		actual, err := websocketUrl(test.address, test.suffix, test.plaintext)
+		check(t, err == nil)
+		compare(t, actual, test.expected)
+	}
+
+	_, err := websocketUrl("ftp://example.com", "", false)
+	check(t, err != nil)
+}
+
+func TestDialUrl(t *testing.T) {
+	l, err := NewHandler(ListenConfig{})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer l.Close()
+
+	// Only let requests through if they have the right headers and query
+	mux := http.NewServeMux()
+	mux.Handle("/realm/eu-1/", http.StripPrefix("/realm/eu-1", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" || r.URL.Query().Get("ticket") != "abc" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		l.ServeHTTP(w, r)
+	})))
+	server := httptest.NewUnstartedServer(mux)
+	server.TLS = tlsConfig()
+	server.StartTLS()
+	defer server.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				io.Copy(c, c)
+				c.Close()
+			}(conn)
+		}
+	}()
+
+	address := strings.Replace(server.URL, "https://", "wss://", 1) + "/realm/eu-1/?ticket=abc"
+	for _, mode := range []DialMode{DialWebRtc, DialWebsocket} {
+		conn, err := DialContext(context.Background(), address, DialConfig{
+			TlsConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+			Header: http.Header{"Authorization": []string{"Bearer token"}},
+			Ordered: true,
+			Mode: mode,
+			Timeout: 10 * time.Second,
+		})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		checkEcho(t, conn, 10)
+		conn.Close()
+	}
+
+	// Missing headers get rejected
+	_, err = DialContext(context.Background(), address, DialConfig{
+		TlsConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+		Timeout: 5 * time.Second,
+	})
+	check(t, err != nil)
+}
+
+func TestAuthenticate(t *testing.T) {
+	_, accepted := listenAccept(t, "localhost:2013", ListenConfig{
+		OriginPatterns: []string{"localhost", "localhost:2013"},
+		Authenticate: func(r *http.Request) (any, error) {
+			user := r.URL.Query().Get("user")
+			if user == "" {
+				return nil, &RejectError{http.StatusUnauthorized, "missing user"}
+			}
+			return user, nil
+		},
+	})
+
+	for _, mode := range []DialMode{DialWebRtc, DialWebsocket} {
+		conn, err := DialContext(context.Background(), "localhost:2013?user=alice", DialConfig{
+			TlsConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+			Ordered: true,
+			Mode: mode,
+			Timeout: 10 * time.Second,
+		})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		check(t, conn.Identity() == nil)
+		lConn := nextAccepted(t, accepted)
+		compare(t, lConn.Identity(), any("alice"))
+		conn.Close()
+		lConn.Close()
+
+		_, err = DialContext(context.Background(), "localhost:2013", DialConfig{
+			TlsConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+			Mode: mode,
+			Timeout: 5 * time.Second,
+		})
+		check(t, err != nil && strings.Contains(err.Error(), "401"))
+	}
+	check(t, len(accepted) == 0)
+}
+
+func TestMetadata(t *testing.T) {
+	_, accepted := listenAccept(t, "localhost:2014", ListenConfig{
+		OriginPatterns: []string{"localhost", "localhost:2014"},
+		Authenticate: func(r *http.Request) (any, error) {
+			return "bob", nil
+		},
+	})
+
+	paths := map[DialMode]string{
+		DialWebRtc: "/game",
+		DialWebsocket: "/game/wss",
+	}
+	for mode, path := range paths {
+		conn, err := DialContext(context.Background(), "wss://localhost:2014/game?realm=eu-1", DialConfig{
+			TlsConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+			Header: http.Header{"X-Client": []string{"v1.2"}},
+			Ordered: true,
+			Mode: mode,
+			Timeout: 10 * time.Second,
+		})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		check(t, conn.Metadata() == nil)
+
+		lConn := nextAccepted(t, accepted)
+		m := lConn.Metadata()
+		compare(t, m.Path, path)
+		compare(t, m.Query.Get("realm"), "eu-1")
+		compare(t, m.Header.Get("X-Client"), "v1.2")
+		compare(t, m.Identity, any("bob"))
+		compare(t, lConn.Identity(), any("bob"))
+		conn.Close()
+		lConn.Close()
+	}
+}
+
+func TestHello(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	_, accepted := listenAccept(t, "localhost:2015", ListenConfig{
+		OriginPatterns: []string{"localhost", "localhost:2015"},
+		Hello: func(m *Metadata, payload []byte) ([]byte, bool) {
+			if string(payload) == "slow" {
+				<-release
+			}
+			if string(payload) == "long" {
+				return []byte(strings.Repeat("é", 100)), false
+			}
+			if string(payload) != "v2" {
+				return []byte("please update"), false
+			}
+			return []byte("welcome"), true
+		},
+	})
+
+	dialMode := func(mode DialMode, hello []byte) (*Conn, error) {
+		return DialContext(context.Background(), "localhost:2015", DialConfig{
+			TlsConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+			Ordered: true,
+			Mode: mode,
+			Hello: hello,
+			Timeout: 10 * time.Second,
+		})
+	}
+	dial := func(hello []byte) (*Conn, error) {
+		return dialMode(DialAuto, hello)
+	}
+
+	conn, err := dial([]byte("v2"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	check(t, conn.Transport() == TransportWebRtc)
+	compare(t, string(conn.HelloReply()), "welcome")
+	lConn := nextAccepted(t, accepted)
+	compare(t, string(lConn.Metadata().Hello), "v2")
+	conn.Close()
+	lConn.Close()
+
+	// Rejected dialers must not fall back to the websocket
+	_, err = dial([]byte("old"))
+	var helloErr *HelloRejectedError
+	check(t, errors.As(err, &helloErr))
+	compare(t, string(helloErr.Reply), "please update")
+	compare(t, err.Error(), "rtcnet: hello rejected: please update")
+
+	_, err = dial(make([]byte, maxHelloSize + 1))
+	check(t, err != nil)
+	check(t, len(accepted) == 0)
+
+	// The hello is also exchanged over the websocket fallback
+	conn, err = dialMode(DialWebsocket, []byte("v2"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	check(t, conn.Transport() == TransportWebsocket)
+	compare(t, string(conn.HelloReply()), "welcome")
+	lConn = nextAccepted(t, accepted)
+	compare(t, string(lConn.Metadata().Hello), "v2")
+	conn.Close()
+	lConn.Close()
+
+	_, err = dialMode(DialWebsocket, []byte("old"))
+	check(t, errors.As(err, &helloErr))
+	compare(t, string(helloErr.Reply), "please update")
+
+	// Replies that don't fit in a close reason are cut down at a rune boundary
+	_, err = dialMode(DialWebsocket, []byte("long"))
+	check(t, errors.As(err, &helloErr))
+	compare(t, string(helloErr.Reply), strings.Repeat("é", 61))
+	check(t, len(accepted) == 0)
+
+	// A slow hello hook must not hold up other fallback dialers
+	go dialMode(DialWebsocket, []byte("slow"))
+	time.Sleep(100 * time.Millisecond)
+	conn, err = dialMode(DialWebsocket, []byte("v2"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	compare(t, string(conn.HelloReply()), "welcome")
+	conn.Close()
+}
+
+func TestProtocolVersion(t *testing.T) {
+	_, accepted := listenAccept(t, "localhost:2016", ListenConfig{
+		OriginPatterns: []string{"localhost", "localhost:2016"},
+		MinProtocolVersion: ProtocolVersion,
+	})
+
+	config := DialConfig{
+		TlsConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+		Ordered: true,
+		Timeout: 10 * time.Second,
+	}
+	conn, err := DialContext(context.Background(), "localhost:2016", config)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	lConn := nextAccepted(t, accepted)
+	compare(t, lConn.Metadata().ProtocolVersion, ProtocolVersion)
+	check(t, slices.Equal(lConn.Metadata().Capabilities, []string{capabilityHello}))
+	conn.Close()
+	lConn.Close()
+
+	// ICE servers are only negotiated by dialers that request them
+	iceConfig := config
+	iceConfig.RequestIceServers = true
+	conn, err = DialContext(context.Background(), "localhost:2016", iceConfig)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	lConn = nextAccepted(t, accepted)
+	check(t, slices.Equal(lConn.Metadata().Capabilities, []string{capabilityHello, capabilityIceServers}))
+	conn.Close()
+	lConn.Close()
+
+	// Dialers that are too old, or that predate versioning, are rejected with a version reply
+	oldDialers := []signalMsg{
+		{Version: &versionMsg{ProtocolVersion - 1, nil}},
+		{SDP: &sdpMsg{webrtc.SDPTypeOffer, "", nil, false, false, false}},
+	}
+	for _, first := range oldDialers {
+		wSock, err := dialWebsocket("localhost:2016", config, context.Background())
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		ctx := context.Background()
+		check(t, sendMsg(ctx, wSock, first) == nil)
+
+		dat, err := wSock.Receive(ctx)
+		check(t, err == nil)
+		var reply signalMsg
+		check(t, json.Unmarshal(dat, &reply) == nil)
+		check(t, reply.VersionReply != nil)
+		check(t, !reply.VersionReply.Accept)
+		compare(t, reply.VersionReply.MinVersion, ProtocolVersion)
+
+		err = checkVersionReply(reply.VersionReply)
+		var versionErr *VersionError
+		check(t, errors.As(err, &versionErr))
+		check(t, isRejected(err))
+
+		// Dialers that predate versioning are sent an answer that they can't apply, so that they fail straight away
+		if first.Version == nil {
+			dat, err = wSock.Receive(ctx)
+			check(t, err == nil)
+			check(t, json.Unmarshal(dat, &reply) == nil)
+			check(t, reply.SDP != nil)
+
+			peerConnection, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+			check(t, err == nil)
+			_, err = peerConnection.CreateDataChannel("data", nil)
+			check(t, err == nil)
+			offer, err := peerConnection.CreateOffer(nil)
+			check(t, err == nil)
+			check(t, peerConnection.SetLocalDescription(offer) == nil)
+			err = peerConnection.SetRemoteDescription(webrtc.SessionDescription{Type: reply.SDP.Type, SDP: reply.SDP.SDP})
+			check(t, err != nil)
+			peerConnection.Close()
+		}
+
+		// The listener hangs up with the reason after rejecting
+		_, err = wSock.Receive(ctx)
+		compare(t, websocket.CloseStatus(err), websocket.StatusPolicyViolation)
+		var closeErr websocket.CloseError
+		check(t, errors.As(err, &closeErr))
+		check(t, strings.Contains(closeErr.Reason, "protocol version"))
+		wSock.Close()
+	}
+}
+
+func TestAcceptDialerFailures(t *testing.T) {
+	l, err := NewListener("localhost:2033", ListenConfig{
+		TlsConfig: tlsConfig(),
+		OriginPatterns: []string{"localhost", "localhost:2033"},
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn)
+	acceptErrs := make(chan error, 16)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				acceptErrs <- err
+				continue
+			}
+			accepted <- conn
+		}
+	}()
+
+	config := DialConfig{
+		TlsConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+		Ordered: true,
+		Timeout: 10 * time.Second,
+	}
+
+	// A hello that is too large, and an offer that can't be parsed
+	badDialers := [][]signalMsg{
+		{{Version: &versionMsg{ProtocolVersion, capabilities}}, {Hello: &helloMsg{make([]byte, maxHelloSize + 1)}}},
+		{{Version: &versionMsg{ProtocolVersion, capabilities}}, {SDP: &sdpMsg{webrtc.SDPTypeOffer, "not an sdp", nil, false, false, false}}},
+	}
+	for _, msgs := range badDialers {
+		wSock, err := dialWebsocket("localhost:2033", config, context.Background())
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+		for _, msg := range msgs {
+			check(t, sendMsg(ctx, wSock, msg) == nil)
+		}
+
+		// The listener hangs up on the dialer
+		for {
+			_, err := wSock.Receive(ctx)
+			if err != nil {
+				break
+			}
+		}
+		check(t, ctx.Err() == nil)
+		cancel()
+		wSock.Close()
+	}
+
+	// An upgrade from an origin that isn't allowed
+	badOrigin := config
+	badOrigin.Header = http.Header{"Origin": []string{"https://evil.example.com"}}
+	_, err = DialContext(context.Background(), "localhost:2033", badOrigin)
+	check(t, err != nil)
+
+	// Accept keeps returning good conns, and never returns the failures of the dialers
+	conn, err := DialContext(context.Background(), "localhost:2033", config)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer conn.Close()
+	lConn := <-accepted
+	defer lConn.Close()
+	check(t, conn.WriteMessage([]byte("hello")) == nil)
+	msg, err := lConn.(*Conn).ReadMessage()
+	check(t, err == nil)
+	compare(t, string(msg), "hello")
+
+	select {
+	case err := <-acceptErrs:
+		t.Fatalf("accept returned a dialer failure: %v", err)
+	default:
+	}
+}
+
+func TestSubprotocols(t *testing.T) {
+	l, err := NewListener("localhost:2034", ListenConfig{
+		TlsConfig: tlsConfig(),
+		OriginPatterns: []string{"localhost", "localhost:2034"},
+		Subprotocols: []string{"game.v2", "game.v1"},
+		Hello: func(m *Metadata, payload []byte) ([]byte, bool) {
+			return []byte("welcome"), true
+		},
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer l.Close()
+
+	accepted := make(chan *Conn)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn.(*Conn)
+		}
+	}()
+
+	for _, mode := range []DialMode{DialWebRtc, DialWebsocket} {
+		for _, subprotocols := range [][]string{{"game.v1"}, {"game.v3", "game.v1", "game.v2"}, nil} {
+			conn, err := DialContext(context.Background(), "localhost:2034", DialConfig{
+				TlsConfig: &tls.Config{
+					InsecureSkipVerify: true,
+				},
+				Ordered: true,
+				Mode: mode,
+				Timeout: 10 * time.Second,
+				Subprotocols: subprotocols,
+				Hello: []byte("v2"),
+			})
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			lConn := <-accepted
+
+			// The preference of the listener wins, and our own subprotocols still apply along with it
+			expected := ""
+			if len(subprotocols) == 1 {
+				expected = "game.v1"
+			} else if len(subprotocols) > 1 {
+				expected = "game.v2"
+			}
+			compare(t, conn.Subprotocol(), expected)
+			compare(t, lConn.Subprotocol(), expected)
+			compare(t, string(conn.HelloReply()), "welcome")
+			compare(t, string(lConn.Metadata().Hello), "v2")
+
+			dat := randomSlice(3 * maxMessageSize)
+			check(t, conn.WriteMessage(dat) == nil)
+			msg, err := lConn.ReadMessage()
+			check(t, err == nil)
+			check(t, bytes.Equal(msg, dat))
+
+			conn.Close()
+			lConn.Close()
+		}
+	}
+}
+
+// A signaler that passes messages over channels, so that both peers can live in the same process
+type chanSignaler struct {
+	send chan<- []byte
+	recv <-chan []byte
+}
+
+func newChanSignalers() (*chanSignaler, *chanSignaler) {
+	a := make(chan []byte, 64)
+	b := make(chan []byte, 64)
+	return &chanSignaler{a, b}, &chanSignaler{b, a}
+}
+
+func (s *chanSignaler) Send(ctx context.Context, msg []byte) error {
+	select {
+	case s.send <- msg:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *chanSignaler) Receive(ctx context.Context) ([]byte, error) {
+	select {
+	case msg := <-s.recv:
+		return msg, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestSignaler(t *testing.T) {
+	dialSignaler, acceptSignaler := newChanSignalers()
+	ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+	defer cancel()
+
+	accepted := make(chan *Conn, 1)
+	go func() {
+		conn, err := AcceptOver(ctx, acceptSignaler, ListenConfig{
+			Hello: func(m *Metadata, payload []byte) ([]byte, bool) {
+				return []byte("welcome"), true
+			},
+		})
+		if err != nil {
+			t.Errorf("%v", err)
+		}
+		accepted <- conn
+	}()
+
+	conn, err := DialOver(ctx, dialSignaler, DialConfig{
+		Ordered: true,
+		Hello: []byte("hi"),
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer conn.Close()
+	compare(t, string(conn.HelloReply()), "welcome")
+	compare(t, conn.RemoteAddr().Network(), "signaler")
+
+	server := <-accepted
+	if server == nil {
+		t.FailNow()
+	}
+	defer server.Close()
+	compare(t, string(server.Metadata().Hello), "hi")
+	compare(t, server.Metadata().ProtocolVersion, ProtocolVersion)
+
+	go func() {
+		msg, err := server.ReadMessage()
+		if err != nil {
+			return
+		}
+		server.WriteMessage(msg)
+	}()
+	check(t, conn.WriteMessage([]byte("hello over a signaler")) == nil)
+	msg, err := conn.ReadMessage()
+	check(t, err == nil)
+	compare(t, string(msg), "hello over a signaler")
+
+	// The muxes belong to a Listener, so they can't be used here
+	_, err = AcceptOver(ctx, acceptSignaler, ListenConfig{UdpMuxAddress: ":2036"})
+	check(t, errors.Is(err, errAcceptOverMux))
+	_, err = AcceptOver(ctx, acceptSignaler, ListenConfig{TcpMuxAddress: ":2036"})
+	check(t, errors.Is(err, errAcceptOverMux))
+}
+
+func TestUpgrade(t *testing.T) {
+	for _, keep := range []bool{true, false} {
+		tcpListener, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+		type result struct {
+			conn *Conn
+			side net.Conn
+			err error
+		}
+		accepted := make(chan result, 1)
+		go func() {
+			side, err := tcpListener.Accept()
+			if err != nil {
+				accepted <- result{nil, nil, err}
+				return
+			}
+			conn, err := AcceptUpgrade(ctx, side, keep, ListenConfig{})
+			accepted <- result{conn, side, err}
+		}()
+
+		side, err := net.Dial("tcp", tcpListener.Addr().String())
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		conn, err := DialUpgrade(ctx, side, keep, DialConfig{
+			Ordered: true,
+		})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		res := <-accepted
+		if res.err != nil {
+			t.Fatalf("%v", res.err)
+		}
+		compare(t, conn.RemoteAddr().String(), side.RemoteAddr().String())
+
+		// The webrtc conn works
+		check(t, conn.WriteMessage([]byte("over webrtc")) == nil)
+		msg, err := res.conn.ReadMessage()
+		check(t, err == nil)
+		compare(t, string(msg), "over webrtc")
+
+		if keep {
+			// The side channel is left clean, without any leftover signalling
+			_, err = side.Write([]byte("side channel"))
+			check(t, err == nil)
+			buf := make([]byte, len("side channel"))
+			_, err = io.ReadFull(res.side, buf)
+			check(t, err == nil)
+			compare(t, string(buf), "side channel")
+		} else {
+			_, err = side.Write([]byte("side channel"))
+			check(t, errors.Is(err, net.ErrClosed))
+		}
+
+		conn.Close()
+		res.conn.Close()
+		side.Close()
+		res.side.Close()
+		tcpListener.Close()
+		cancel()
+	}
+}
+
+func TestHttpSignalling(t *testing.T) {
+	l := listenEcho(t, "localhost:2017", ListenConfig{
+		TlsConfig: tlsConfig(),
+		OriginPatterns: []string{"localhost", "localhost:2017"},
+		Authenticate: func(r *http.Request) (any, error) {
+			if r.Header.Get("X-Token") != "secret" {
+				return nil, &RejectError{http.StatusUnauthorized, "bad token"}
+			}
+			return nil, nil
+		},
+		Hello: func(m *Metadata, payload []byte) ([]byte, bool) {
+			if string(payload) != "v2" {
+				return []byte("please update"), false
+			}
+			return []byte("welcome"), true
+		},
+	})
+	defer l.Close()
+
+	dial := func(token string, hello string) (*Conn, error) {
+		return DialContext(context.Background(), "localhost:2017", DialConfig{
+			TlsConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+			Header: http.Header{"X-Token": []string{token}},
+			HttpSignalling: true,
+			Ordered: true,
+			Hello: []byte(hello),
+			Timeout: 10 * time.Second,
+		})
+	}
+
+	conn, err := dial("secret", "v2")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	check(t, conn.Transport() == TransportWebRtc)
+	compare(t, string(conn.HelloReply()), "welcome")
+	checkEcho(t, conn, 10)
+	conn.Close()
+
+	_, err = dial("secret", "old")
+	var helloErr *HelloRejectedError
+	check(t, errors.As(err, &helloErr))
+	compare(t, string(helloErr.Reply), "please update")
+
+	_, err = dial("wrong", "v2")
+	check(t, err != nil && strings.Contains(err.Error(), "(401): bad token"))
+
+	// Browsers on other origins must pass the origin patterns, and are sent CORS headers
+	client := newHttpClient(&tls.Config{InsecureSkipVerify: true})
+	request := func(method, origin, contentType string) *http.Response {
+		req, err := http.NewRequest(method, "https://localhost:2017", strings.NewReader("[]"))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		req.Header.Set("X-Token", "secret")
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Access-Control-Request-Headers", "content-type,x-token")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := request(http.MethodPost, "https://evil.example.com", "application/json")
+	compare(t, resp.StatusCode, http.StatusForbidden)
+	compare(t, resp.Header.Get("Access-Control-Allow-Origin"), "")
+
+	resp = request(http.MethodPost, "https://localhost", "text/plain")
+	compare(t, resp.StatusCode, http.StatusUnsupportedMediaType)
+	compare(t, resp.Header.Get("Access-Control-Allow-Origin"), "https://localhost")
+
+	resp = request(http.MethodOptions, "https://localhost", "")
+	compare(t, resp.StatusCode, http.StatusNoContent)
+	compare(t, resp.Header.Get("Access-Control-Allow-Origin"), "https://localhost")
+	compare(t, resp.Header.Get("Access-Control-Allow-Methods"), http.MethodPost)
+	compare(t, resp.Header.Get("Access-Control-Allow-Headers"), "content-type,x-token")
+
+	resp = request(http.MethodOptions, "https://evil.example.com", "")
+	compare(t, resp.StatusCode, http.StatusForbidden)
+}
+
+// Counts the candidate messages that are sent through the signaler
+type countingSignaler struct {
+	Signaler
+	candidates atomic.Int32
+}
+
+func (s *countingSignaler) Send(ctx context.Context, msg []byte) error {
+	var m signalMsg
+	if json.Unmarshal(msg, &m) == nil && m.Candidate != nil {
+		s.candidates.Add(1)
+	}
+	return s.Signaler.Send(ctx, msg)
+}
+
+func TestNoTrickle(t *testing.T) {
+	// Either side can ask for non-trickle signalling. If the dialer asks, then neither side trickles
+	tests := []struct {
+		dialNoTrickle, listenNoTrickle bool
+	}{
+		{true, false},
+		{false, true},
+	}
+	for _, test := range tests {
+		a, b := newChanSignalers()
+		dialSignaler := &countingSignaler{Signaler: a}
+		acceptSignaler := &countingSignaler{Signaler: b}
+		ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+
+		accepted := make(chan *Conn, 1)
+		go func() {
+			conn, err := AcceptOver(ctx, acceptSignaler, ListenConfig{
+				NoTrickle: test.listenNoTrickle,
+			})
+			if err != nil {
+				t.Errorf("%v", err)
+			}
+			accepted <- conn
+		}()
+
+		conn, err := DialOver(ctx, dialSignaler, DialConfig{
+			Ordered: true,
+			NoTrickle: test.dialNoTrickle,
+		})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		server := <-accepted
+		if server == nil {
+			t.FailNow()
+		}
+
+		compare(t, acceptSignaler.candidates.Load(), 0)
+		if test.dialNoTrickle {
+			compare(t, dialSignaler.candidates.Load(), 0)
+		}
+
+		check(t, conn.WriteMessage([]byte("no trickle")) == nil)
+		msg, err := server.ReadMessage()
+		check(t, err == nil)
+		compare(t, string(msg), "no trickle")
+
+		conn.Close()
+		server.Close()
+		cancel()
+	}
+}
+
+func TestNetworkConfig(t *testing.T) {
+	network := NetworkConfig{
+		NAT1To1IPs: []string{"127.0.0.1"},
+		PortMin: 42000,
+		PortMax: 42100,
+		NetworkTypes: []webrtc.NetworkType{webrtc.NetworkTypeUDP4},
+		InterfaceFilter: func(name string) bool {
+			return true
+		},
+		FailedTimeout: 10 * time.Second,
+	}
+	_, accepted := listenAccept(t, "localhost:2018", ListenConfig{
+		OriginPatterns: []string{"localhost", "localhost:2018"},
+		Network: network,
+	})
+
+	config := DialConfig{
+		TlsConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+		Ordered: true,
+		Network: NetworkConfig{
+			NetworkTypes: []webrtc.NetworkType{webrtc.NetworkTypeUDP4},
+		},
+		Timeout: 10 * time.Second,
+	}
+	conn, err := DialContext(context.Background(), "localhost:2018", config)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	lConn := nextAccepted(t, accepted)
+	pair := selectedPair(t, lConn)
+	compare(t, pair.Local.Address, "127.0.0.1")
+	check(t, pair.Local.Port >= network.PortMin && pair.Local.Port <= network.PortMax)
+	conn.Close()
+	lConn.Close()
+
+	// Invalid settings fail the dial
+	config.Network.PortMin = 100
+	config.Network.PortMax = 10
+	_, err = DialContext(context.Background(), "localhost:2018", config)
+	check(t, err != nil)
+}
+
+func TestUdpMux(t *testing.T) {
+	l, accepted := listenAccept(t, "localhost:2019", ListenConfig{
+		OriginPatterns: []string{"localhost", "localhost:2019"},
+		UdpMuxAddress: ":2019",
+	})
+
+	// Every peer shares the one port
+	var conns []*Conn
+	for i := 0; i < 2; i++ {
+		conn, err := DialContext(context.Background(), "localhost:2019", DialConfig{
+			TlsConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+			Ordered: true,
+			Timeout: 10 * time.Second,
+		})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		lConn := nextAccepted(t, accepted)
+		compare(t, selectedPair(t, lConn).Local.Port, uint16(2019))
+		conns = append(conns, conn, lConn)
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+
+	// The port is held by the listener until it closes
+	_, err := NewListener("localhost:2019", ListenConfig{
+		TlsConfig: tlsConfig(),
+		UdpMuxAddress: ":2019",
+	})
+	check(t, err != nil)
+
+	check(t, l.Close() == nil)
+	udpConn, err := net.ListenPacket("udp", ":2019")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	udpConn.Close()
+}
+
+func TestTcpMux(t *testing.T) {
+	_, accepted := listenAccept(t, "localhost:2020", ListenConfig{
+		OriginPatterns: []string{"localhost", "localhost:2020"},
+		TcpMuxAddress: ":2021",
+		Network: NetworkConfig{
+			NetworkTypes: []webrtc.NetworkType{webrtc.NetworkTypeTCP4}, // Note: Act like UDP is blocked
+		},
+	})
+
+	conn, err := DialContext(context.Background(), "localhost:2020", DialConfig{
+		TlsConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+		Ordered: true,
+		Timeout: 10 * time.Second,
+		Network: NetworkConfig{
+			NetworkTypes: []webrtc.NetworkType{webrtc.NetworkTypeUDP4, webrtc.NetworkTypeTCP4},
+		},
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer conn.Close()
+	lConn := nextAccepted(t, accepted)
+	defer lConn.Close()
+
+	pair := selectedPair(t, lConn)
+	compare(t, pair.Local.Protocol, webrtc.ICEProtocolTCP)
+	compare(t, pair.Local.Port, uint16(2021))
+
+	// Messages flow over ICE-TCP
+	check(t, conn.WriteMessage([]byte("over tcp")) == nil)
+	msg, err := lConn.ReadMessage()
+	check(t, err == nil)
+	compare(t, string(msg), "over tcp")
+}
+
+// Starts a TURN server on the UDP address, which authenticates users with the password that is returned by the password func
+func listenTurn(t *testing.T, address string, password func(username string) (string, bool)) *turn.Server {
+	udpConn, err := net.ListenPacket("udp4", address)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm: "rtcnet",
+		AuthHandler: func(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+			pass, ok := password(username)
+			if !ok {
+				return nil, false
+			}
+			return turn.GenerateAuthKey(username, realm, pass), true
+		},
+		PacketConnConfigs: []turn.PacketConnConfig{
+			{
+				PacketConn: udpConn,
+				RelayAddressGenerator: &turn.RelayAddressGeneratorStatic{
+					RelayAddress: net.ParseIP("127.0.0.1"),
+					Address: "127.0.0.1",
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return server
+}
+
+func TestIceServers(t *testing.T) {
+	turnServer := listenTurn(t, "127.0.0.1:42300", func(username string) (string, bool) {
+		return "password", username == "user"
+	})
+	defer turnServer.Close()
+
+	// Note: The first server has the wrong credentials, so only the second one can be used
+	network := NetworkConfig{
+		IceServers: []webrtc.ICEServer{
+			{
+				URLs: []string{"turn:127.0.0.1:42300?transport=udp"},
+				Username: "user",
+				Credential: "wrong",
+			},
+			{
+				URLs: []string{"turn:127.0.0.1:42300?transport=udp"},
+				Username: "user",
+				Credential: "password",
+			},
+		},
+		IceTransportPolicy: webrtc.ICETransportPolicyRelay,
+	}
+	_, accepted := listenAccept(t, "localhost:2022", ListenConfig{
+		OriginPatterns: []string{"localhost", "localhost:2022"},
+		Network: network,
+	})
+
+	conn, err := DialContext(context.Background(), "localhost:2022", DialConfig{
+		TlsConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+		Ordered: true,
+		Timeout: 10 * time.Second,
+		Network: network,
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer conn.Close()
+	lConn := nextAccepted(t, accepted)
+	defer lConn.Close()
+
+	compare(t, selectedPair(t, lConn).Local.Typ, webrtc.ICECandidateTypeRelay)
+	compare(t, selectedPair(t, conn).Local.Typ, webrtc.ICECandidateTypeRelay)
+
+	// Messages flow through the relay
+	check(t, conn.WriteMessage([]byte("relayed")) == nil)
+	msg, err := lConn.ReadMessage()
+	check(t, err == nil)
+	compare(t, string(msg), "relayed")
+
+	// Without any TURN server, the relay policy has nothing to connect with
+	_, err = DialContext(context.Background(), "localhost:2022", DialConfig{
+		TlsConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+		Timeout: 2 * time.Second,
+		Network: NetworkConfig{
+			IceTransportPolicy: webrtc.ICETransportPolicyRelay,
+		},
+	})
+	check(t, err != nil)
+}
+
+func TestTurnRest(t *testing.T) {
+	// Note: This checks credentials the same way as coturn with use-auth-secret
+	secret := "turn-secret"
+	var lastUser atomic.Value
+	var minted atomic.Int32
+	turnServer := listenTurn(t, "127.0.0.1:42301", func(username string) (string, bool) {
+		expiry, user, _ := strings.Cut(username, ":")
+		timestamp, err := strconv.ParseInt(expiry, 10, 64)
+		if err != nil || time.Unix(timestamp, 0).Before(time.Now()) {
+			return "", false
+		}
+		lastUser.Store(user)
+		_, credential := turnRestCredentials(secret, user, time.Unix(timestamp, 0))
+		return credential, true
+	})
+	defer turnServer.Close()
+
+	l := listenEcho(t, "localhost:2023", ListenConfig{
+		OriginPatterns: []string{"localhost", "localhost:2023"},
+		Authenticate: func(r *http.Request) (any, error) {
+			return "alice", nil
+		},
+		Hello: func(metadata *Metadata, payload []byte) ([]byte, bool) {
+			return nil, string(payload) != "banned"
+		},
+		TurnRest: &TurnRestConfig{
+			URLs: []string{"turn:127.0.0.1:42301?transport=udp"},
+			Secret: secret,
+			TTL: time.Minute,
+			User: func(metadata *Metadata) string {
+				minted.Add(1)
+				return metadata.Identity.(string)
+			},
+		},
+	})
+	defer l.Close()
+
+	// The dialer has no credentials of its own, and can only connect through the relay
+	conn, err := DialContext(context.Background(), "localhost:2023", DialConfig{
+		TlsConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+		Ordered: true,
+		Timeout: 10 * time.Second,
+		RequestIceServers: true,
+		Network: NetworkConfig{
+			IceTransportPolicy: webrtc.ICETransportPolicyRelay,
+		},
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer conn.Close()
+
+	pair, err := conn.peerConn.SCTP().Transport().ICETransport().GetSelectedCandidatePair()
+	check(t, err == nil && pair != nil)
+	compare(t, pair.Local.Typ, webrtc.ICECandidateTypeRelay)
+	compare(t, lastUser.Load(), any("alice"))
+	compare(t, minted.Load(), int32(1))
+	checkEcho(t, conn, 10)
+
+	// Credentials are only minted for dialers that request them
+	direct, err := DialContext(context.Background(), "localhost:2023", DialConfig{
+		TlsConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+		Ordered: true,
+		Timeout: 10 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	checkEcho(t, direct, 10)
+	direct.Close()
+	compare(t, minted.Load(), int32(1))
+
+	// Credentials are only minted once the hello is accepted
+	_, err = DialContext(context.Background(), "localhost:2023", DialConfig{
+		TlsConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+		Ordered: true,
+		Timeout: 10 * time.Second,
+		RequestIceServers: true,
+		Hello: []byte("banned"),
+	})
+	var rejected *HelloRejectedError
+	check(t, errors.As(err, &rejected))
+	compare(t, minted.Load(), int32(1))
+
+	// Credentials match the coturn use-auth-secret scheme. The expected values were computed with openssl: printf '%s' "$username" | openssl dgst -sha1 -hmac turn-secret -binary | base64
+	username, credential := turnRestCredentials(secret, "", time.Unix(1700000000, 0))
+	compare(t, username, "1700000000")
+	compare(t, credential, "YIvHtPEA7x5/zL+norNZ2T7b7SQ=")
+	username, credential = turnRestCredentials(secret, "alice", time.Unix(1700000000, 0))
+	compare(t, username, "1700000000:alice")
+	compare(t, credential, "P/+m9gKVzGM5rBfJY3JtNseUl3o=")
+	_, otherCredential := turnRestCredentials("other-secret", "alice", time.Unix(1700000000, 0))
+	check(t, credential != otherCredential)
+
+	// Requesting ICE servers can't work without waiting for the listener
+	_, err = DialContext(context.Background(), "localhost:2023", DialConfig{
+		TlsConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+		Timeout: 2 * time.Second,
+		RequestIceServers: true,
+		HttpSignalling: true,
+	})
+	check(t, err != nil)
+}
+
+func TestWebsocketReadLimit(t *testing.T) {
+	l, err := NewListener("localhost:2030", ListenConfig{
+		TlsConfig: tlsConfig(),
+		OriginPatterns: []string{"localhost", "localhost:2030"},
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer l.Close()
+
+	readErrs := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			readErrs <- err
+			return
+		}
+		_, err = conn.Read(make([]byte, 2 * maxMessageSize))
+		readErrs <- err
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+	wsConn, err := dialWs(ctx, "wss://localhost:2030/wss", &tls.Config{InsecureSkipVerify: true}, nil, []string{fragmentSubprotocol})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer wsConn.CloseNow()
+
+	// A message larger than any fragment is refused instead of buffered
+	wsConn.Write(ctx, websocket.MessageBinary, make([]byte, maxMessageSize + 1))
+	check(t, <-readErrs != nil)
+	_, _, err = wsConn.Read(ctx)
+	compare(t, websocket.CloseStatus(err), websocket.StatusMessageTooBig)
+}
@@ -4,46 +4,431 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"net"
+	"net/http"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/pion/webrtc/v4"
 )
 
+// The default amount of time that Dial will wait for the connection to finish getting setup
+const defaultDialTimeout = 10 * time.Second
+
+// The default amount of time that DialAuto will spend attempting webrtc before falling back to websockets
+const defaultWebRtcTimeout = 5 * time.Second
+
+// The default head start that DialRace gives webrtc before also dialing the websocket fallback
+const defaultFallbackDelay = 1 * time.Second
+
+// Determines which transport is used to dial a connection
+type DialMode uint8
+
+const (
+	DialWebRtc DialMode = iota // Only attempt a webrtc connection (Default)
+	DialWebsocket // Only use the websocket fallback. Useful for networks that block UDP
+	DialAuto // Attempt a webrtc connection, and if that fails then use the websocket fallback
+	DialRace // Attempt a webrtc connection, and after a head start also dial the websocket fallback. Whichever connects first is used
+)
+
+// Configuration for dialing a connection
+type DialConfig struct {
+	TlsConfig *tls.Config
+
+	// Extra HTTP headers to send with the websocket requests, such as Authorization or Cookie. Browsers don't allow custom websocket headers, so these are ignored in wasm
+	Header http.Header
+
+	// Websocket subprotocols of the application to request, in order of preference. Browsers fail the dial if the listener doesn't accept one of them in ListenConfig.Subprotocols. See Conn.Subprotocol
+	Subprotocols []string
+
+	// If true, dial with ws:// instead of wss:// when the address has no scheme. This sends signalling and websocket fallback data without encryption, so it should only be used for local development, or when dialing through a proxy on a trusted network. Webrtc data is always encrypted
+	Plaintext bool
+
+	IceServers []string // STUN or TURN urls that don't need credentials. See Network.IceServers for full ICE server descriptors
+	Ordered bool // If true, the data channel will deliver messages in order
+	Mode DialMode
+
+	// The maximum amount of time to wait for the connection to finish getting setup. This is applied on top of any deadline that is already set on the dialing context. If zero, then only the context is used.
+	Timeout time.Duration
+
+	// When using DialAuto, this is the maximum amount of time to spend attempting a webrtc connection before falling back to the websocket. If zero, then a default is used.
+	WebRtcTimeout time.Duration
+
+	// When using DialRace, this is the head start that webrtc negotiation gets before the websocket fallback is also dialed. If zero, then a default is used.
+	FallbackDelay time.Duration
+
+	// Reliability of the primary data channel. If either is set, then the channel is unreliable. See ChannelConfig
+	// Note: If the primary data channel is reliable and ordered, then large messages are automatically fragmented, as long as the listener supports it
+	MaxRetransmits *uint16
+	MaxPacketLifeTime *uint16
+
+	// If true, webrtc is negotiated with a single HTTP POST to the address instead of over a signalling websocket, like WHIP, for hosts that don't allow long lived websockets. The websocket fallback of DialAuto and DialRace still uses a websocket
+	HttpSignalling bool
+
+	// If true, the offer and the answer are only sent once they contain every ICE candidate, so that no candidates are trickled. Negotiating takes a bit longer. This is always true for HttpSignalling
+	NoTrickle bool
+
+	// If set, this opaque payload is sent to the listener before any webrtc negotiation happens, for things like the client version or a login token. The listener can accept or reject the dialer with a reply payload, see ListenConfig.Hello and Conn.HelloReply. This must be smaller than 4 KB, and requires a listener that supports hellos.
+	// The hello is also sent over the websocket fallback, which then requires a listener that supports fallback hellos. Rejected dialers will not fall back to the websocket
+	Hello []byte
+
+	// ICE network settings, like ICE servers, NAT 1:1 IPs and port ranges. Only the ICE servers and transport policy apply to wasm builds
+	Network NetworkConfig
+
+	// If true, the listener is asked for ICE servers in its hello reply, like TURN servers with credentials that it minted for this dial, see ListenConfig.TurnRest. This can't be used with HttpSignalling
+	RequestIceServers bool
+
+	// If true, the returned conn has byte stream semantics, like a TCP conn, instead of message semantics. See Conn.Read. This only applies to the primary data channel, which must be Ordered and reliable
+	Stream bool
+
+	// If true, an unordered data channel that never retransmits is also opened. It can be used as a net.PacketConn through Conn.PacketConn
+	PacketChannel bool
+
+	// Additional data channels to open on the same peer connection. They can be retrieved with Conn.Channel once the connection is returned. These are ignored by the websocket fallback
+	Channels []ChannelConfig
+}
+
+// The label of the primary data channel of every connection
+const primaryChannelLabel = "data"
+
+// Configuration for a data channel
+type ChannelConfig struct {
+	Label string
+	Ordered bool // If true, the channel will deliver messages in order
+
+	// If set, the channel is unreliable and will retransmit a message at most this many times. Set to 0 to never retransmit
+	MaxRetransmits *uint16
+
+	// If set, the channel is unreliable and will retransmit a message for at most this many milliseconds
+	MaxPacketLifeTime *uint16
+}
+
+func (c ChannelConfig) dataChannelInit() *webrtc.DataChannelInit {
+	return &webrtc.DataChannelInit{
+		Ordered: &c.Ordered,
+		MaxRetransmits: c.MaxRetransmits,
+		MaxPacketLifeTime: c.MaxPacketLifeTime,
+	}
+}
+
+// Returns true if the channel delivers every message in order
+func (c ChannelConfig) reliable() bool {
+	return c.Ordered && c.MaxRetransmits == nil && c.MaxPacketLifeTime == nil
+}
+
+// Returns true if the opened data channel delivers every message in order
+func isReliable(d *webrtc.DataChannel) bool {
+	return d.Ordered() && d.MaxRetransmits() == nil && d.MaxPacketLifeTime() == nil
+}
+
+// Returned when stream mode is used with a primary channel that can drop or reorder messages, because the bytes of the stream would be silently lost or reordered
+var errStreamUnreliable = errors.New("rtcnet: stream mode requires an ordered and reliable primary channel")
+
+func (c DialConfig) primaryChannel() ChannelConfig {
+	return ChannelConfig{
+		Label: primaryChannelLabel,
+		Ordered: c.Ordered,
+		MaxRetransmits: c.MaxRetransmits,
+		MaxPacketLifeTime: c.MaxPacketLifeTime,
+	}
+}
+
+func channelLabels(channels []ChannelConfig) []string {
+	labels := make([]string, 0, len(channels))
+	for _, c := range channels {
+		labels = append(labels, c.Label)
+	}
+	return labels
+}
+
+// Dials the address and returns a connection. The address is either a host with an optional path, like "example.com:443/realm", or a full url with a path and query, like "wss://example.com/realm/eu-1?ticket=abc". This is a helper function for DialContext which uses a background context and the default dial timeout.
 func Dial(address string, tlsConfig *tls.Config, ordered bool, iceServers []string) (*Conn, error) {
-	dialCtx, cancel := context.WithTimeout(context.Background(), 10 * time.Second) // TODO: pass in timeout
+	return DialContext(context.Background(), address, DialConfig{
+		TlsConfig: tlsConfig,
+		IceServers: iceServers,
+		Ordered: ordered,
+		Timeout: defaultDialTimeout,
+	})
+}
+
+// Returns an error if the config can't be dialed with
+func (c DialConfig) validate() error {
+	if len(c.Hello) > maxHelloSize {
+		return fmt.Errorf("rtcnet: hello payload is larger than %d bytes", maxHelloSize)
+	}
+	// Note: The websocket is always reliable, so only check when webrtc could be used
+	if c.Stream && c.Mode != DialWebsocket && !c.primaryChannel().reliable() {
+		return errStreamUnreliable
+	}
+	return nil
+}
+
+// Returns a child context of the dial, which also expires after the timeout if it is set
+func withDialTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// Dials the address and returns a connection. If the context is cancelled before the connection is finished getting setup, then the websocket, the signalling goroutine, and the pending webrtc peer connection are all torn down and the context error is returned. Once DialContext returns, cancelling the context has no effect on the returned connection.
+func DialContext(ctx context.Context, address string, config DialConfig) (*Conn, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	dialCtx, cancel := withDialTimeout(ctx, config.Timeout)
+	defer cancel()
+
+	switch config.Mode {
+	case DialWebsocket:
+		return dialWebsocketFallback(dialCtx, address, config)
+	case DialAuto:
+		webRtcTimeout := config.WebRtcTimeout
+		if webRtcTimeout <= 0 {
+			webRtcTimeout = defaultWebRtcTimeout
+		}
+		webRtcCtx, webRtcCancel := context.WithTimeout(dialCtx, webRtcTimeout)
+		defer webRtcCancel()
+
+		conn, err := dialWebRtc(webRtcCtx, address, config)
+		if err == nil {
+			return conn, nil
+		}
+		if dialCtx.Err() != nil {
+			return nil, dialCtx.Err() // The caller gave up, so don't attempt the fallback
+		}
+		if isRejected(err) {
+			return nil, err // The listener rejected us, so the fallback would be rejected too
+		}
+
+		logger.Warn().
+			Err(err).
+			Msg("Dial: webrtc failed, falling back to websocket")
+		return dialWebsocketFallback(dialCtx, address, config)
+	case DialRace:
+		return dialRace(dialCtx, address, config)
+	default:
+		return dialWebRtc(dialCtx, address, config)
+	}
+}
+
+// Returned when the listener rejects the hello payload of the dialer
+type HelloRejectedError struct {
+	Reply []byte // The reply payload from the listener, which can contain a readable reason
+}
+
+func (e *HelloRejectedError) Error() string {
+	return "rtcnet: hello rejected: " + string(e.Reply)
+}
+
+// Returned when the listener doesn't support the signalling protocol version of the dialer, which usually means that the dialer is out of date
+type VersionError struct {
+	Version int // The protocol version of the dialer
+	MinVersion int // The oldest protocol version that the listener accepts
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("rtcnet: protocol version %d is no longer supported by the listener, which requires version %d or newer. The client must be updated", e.Version, e.MinVersion)
+}
+
+// Returns the capabilities that the dialer advertises. ICE servers are only advertised when they are requested, so that the listener doesn't mint TURN credentials for dialers that won't use them
+func (c DialConfig) capabilities() []string {
+	if c.RequestIceServers {
+		return capabilities
+	}
+	return slices.DeleteFunc(slices.Clone(capabilities), func(capability string) bool {
+		return capability == capabilityIceServers
+	})
+}
+
+// Returns true if the listener deliberately rejected the dial, in which case the websocket fallback would be rejected too
+func isRejected(err error) bool {
+	var helloErr *HelloRejectedError
+	var versionErr *VersionError
+	return errors.As(err, &helloErr) || errors.As(err, &versionErr)
+}
+
+// Returns an error if the listener rejected our protocol version
+func checkVersionReply(reply *versionReplyMsg) error {
+	if !reply.Accept {
+		return &VersionError{ProtocolVersion, reply.MinVersion}
+	}
+	return nil
+}
+
+type dialResult struct {
+	conn *Conn
+	err error
+}
+
+// Starts dialing webrtc, and then after the fallback delay also dials the websocket fallback. Returns whichever transport connects first and tears down the other one
+func dialRace(ctx context.Context, address string, config DialConfig) (*Conn, error) {
+	raceCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	wSock, err := dialWebsocket(address, tlsConfig, dialCtx)
+	results := make(chan dialResult, 2) // Note: Buffered so that the loser never blocks
+	go func() {
+		conn, err := dialWebRtc(raceCtx, address, config)
+		results <- dialResult{conn, err}
+	}()
+
+	fallbackDelay := config.FallbackDelay
+	if fallbackDelay <= 0 {
+		fallbackDelay = defaultFallbackDelay
+	}
+	fallbackTimer := time.NewTimer(fallbackDelay)
+	defer fallbackTimer.Stop()
+
+	pending := 1
+	fallbackStarted := false
+	startFallback := func() {
+		if fallbackStarted { return }
+		fallbackStarted = true
+		pending++
+		trace("Dial: starting websocket fallback race")
+		go func() {
+			conn, err := dialWebsocketFallback(raceCtx, address, config)
+			results <- dialResult{conn, err}
+		}()
+	}
+
+	// Cancels any pending dial, and closes it if it happened to also connect
+	abandon := func() {
+		cancel()
+		go func(pending int) {
+			for i := 0; i < pending; i++ {
+				loser := <-results
+				if loser.err == nil {
+					loser.conn.Close()
+				}
+			}
+		}(pending)
+	}
+
+	var errs []error
+	for {
+		select {
+		case <-fallbackTimer.C:
+			startFallback()
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				logger.Debug().
+					Stringer("Transport", res.conn.Transport()).
+					Msg("Dial: race finished")
+
+				abandon()
+				return res.conn, nil
+			}
+
+			errs = append(errs, res.err)
+			if ctx.Err() != nil {
+				abandon()
+				return nil, ctx.Err()
+			}
+
+			// If the listener rejected us, then there is no reason to keep racing
+			if isRejected(res.err) {
+				abandon()
+				return nil, res.err
+			}
+
+			// If webrtc fails before its head start is over, then there is no reason to keep waiting
+			startFallback()
+			if pending == 0 {
+				return nil, errors.Join(errs...)
+			}
+		}
+	}
+}
+
+// Dials the address and negotiates a webrtc connection. The websocket and any pending webrtc state are torn down if the context is cancelled before the connection finishes getting setup
+func dialWebRtc(dialCtx context.Context, address string, config DialConfig) (*Conn, error) {
+	if config.HttpSignalling {
+		signaler, err := newHttpDialSignaler(address, config)
+		if err != nil {
+			return nil, err
+		}
+		return dialOver(dialCtx, signaler, config)
+	}
+
+	// Note: The websocket lifetime is bound to dialCtx
+	wSock, err := dialWebsocket(address, config, dialCtx)
 	if err != nil {
 		return nil, err
 	}
 	defer wSock.Close()
 
+	conn, err := dialOver(dialCtx, wSock, config)
+	if err != nil {
+		return nil, err
+	}
+	conn.subprotocol = wSock.conn.Subprotocol()
+	return conn, nil
+}
+
+// Negotiates a webrtc connection over the signaler. Any pending webrtc state is torn down if the context is cancelled before the connection finishes getting setup
+func dialOver(dialCtx context.Context, signaler Signaler, config DialConfig) (*Conn, error) {
+	// Note: Cancelled when we return, so that the signalling goroutine stops reading from the signaler
+	signalCtx, signalCancel := context.WithCancel(dialCtx)
+	defer signalCancel()
+
+	// Note: We don't wait for the version reply, because listeners that predate versioning never send one. The listener replies before answering our offer, so the reply is handled by the signalling goroutine
+	err := sendMsg(signalCtx, signaler, signalMsg{
+		Version: &versionMsg{ProtocolVersion, config.capabilities()},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Note: HTTP signalling sends every message in one request, so all of the candidates are gathered before the offer is sent
+	_, httpSignalling := signaler.(*httpDialSignaler)
+	noTrickle := httpSignalling || config.NoTrickle
+
+	if config.RequestIceServers && httpSignalling {
+		return nil, errors.New("rtcnet: ice servers can't be requested with http signalling")
+	}
+
+	// Note: The hello is exchanged before any webrtc resources are created, and its reply carries the requested ICE servers. HTTP signalling can't wait for a reply though, so the reply is handled by the signalling goroutine instead
+	var helloReply []byte
+	var iceServers []webrtc.ICEServer
+	helloReplies := make(chan []byte, 1)
+	if config.Hello != nil || config.RequestIceServers {
+		if httpSignalling {
+			err = sendMsg(signalCtx, signaler, signalMsg{
+				Hello: &helloMsg{config.Hello},
+			})
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			reply, err := exchangeHello(signalCtx, signaler, config.Hello)
+			if err != nil {
+				return nil, err
+			}
+			helloReply = reply.Payload
+			iceServers = toIceServers(reply.IceServers)
+		}
+	}
+
 	// Offer WebRtc Upgrade
 	var candidatesMux sync.Mutex
 	pendingCandidates := make([]*webrtc.ICECandidate, 0)
 
-	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			// {
-			// 	URLs: []string{"stun:stun.l.google.com:19302"},
-			// },
-		},
-	}
-	if len(iceServers) > 0 {
-		config.ICEServers = append(config.ICEServers,
-			webrtc.ICEServer{
-				URLs: iceServers,
-			})
-	}
+	rtcConfig := getRtcConfiguration(config.IceServers, config.Network)
+	rtcConfig.ICEServers = append(rtcConfig.ICEServers, iceServers...)
 	trace("Dial: Starting WebRTC negotiation")
 
-	api := getSettingsEngineApi()
+	api, err := getSettingsEngineApi(config.Network)
+	if err != nil {
+		return nil, err
+	}
 
-	peerConnection, err := api.NewPeerConnection(config)
+	peerConnection, err := api.NewPeerConnection(rtcConfig)
 	if err != nil {
 		logger.Error().
 			Err(err).
@@ -51,13 +436,31 @@ func Dial(address string, tlsConfig *tls.Config, ordered bool, iceServers []stri
 		return nil, err
 	}
 
-	conn := newConn(peerConnection, wSock.LocalAddr(), wSock.RemoteAddr())
-	connFinish := make(chan bool)
+	localAddr, remoteAddr := signalerAddrs(signaler)
+	conn := newConn(peerConnection, localAddr, remoteAddr)
+	conn.stream = config.Stream
+	conn.helloReply = helloReply // Note: Set later for HTTP signalling
+	connFinish := make(chan bool, 1) // Note: Buffered so that OnOpen doesn't block if we have already given up on the dial
+
+	// If we fail to finish dialing for any reason, then tear down the pending peer connection
+	success := false
+	defer func() {
+		if !success {
+			conn.Close()
+		}
+	}()
 	peerConnection.OnICECandidate(func(c *webrtc.ICECandidate) {
 		logger.Trace().Msg("Dial: peerConnection.OnICECandidate")
 		if c == nil {
 			return
 		}
+		if noTrickle {
+			return // The candidates are sent in the offer instead
+		}
+
+		if signalCtx.Err() != nil {
+			return // The negotiation is over, so there is no one to send the candidate to
+		}
 
 		candidatesMux.Lock()
 		defer candidatesMux.Unlock()
@@ -69,7 +472,7 @@ func Dial(address string, tlsConfig *tls.Config, ordered bool, iceServers []stri
 			sigMsg := signalMsg{
 				Candidate: &candidateMsg{c.ToJSON()},
 			}
-			err := sendMsg(wSock, sigMsg)
+			err := sendMsg(signalCtx, signaler, sigMsg)
 			if err != nil {
 				logger.Error().
 					Err(err).
@@ -81,25 +484,28 @@ func Dial(address string, tlsConfig *tls.Config, ordered bool, iceServers []stri
 	})
 
 	go func() {
-		buf := make([]byte, 8 * 1024)
 		for {
-			n, err := wSock.Read(buf)
+			dat, err := signaler.Receive(signalCtx)
 			if err != nil {
+				if signalCtx.Err() != nil {
+					return // The negotiation is over
+				}
+
 				// TODO: Are there any cases where we might get an error here but its not fatal?
-				// Assume the websocket is closed and break
+				// Assume the signaler is closed and break
 				logger.Error().
 					Err(err).
-					Msg("Failed to read from websocket")
+					Msg("Failed to receive from signaler")
 
 				// TODO: We don't want this to cause an error, if it closed for normal reasons. Else we do want it to cause an error
 				// conn.pushErrorData(err)
 				return
 			}
 
-			if n == 0 { continue }
+			if len(dat) == 0 { continue }
 
 			var msg signalMsg
-			err = json.Unmarshal(buf[:n], &msg)
+			err = json.Unmarshal(dat, &msg)
 			if err != nil {
 				// There was some problem with the unmarshal. Let's just continue looking for another valid message
 				logger.Error().
@@ -114,6 +520,9 @@ func Dial(address string, tlsConfig *tls.Config, ordered bool, iceServers []stri
 				sdp.Type = msg.SDP.Type
 				sdp.SDP = msg.SDP.SDP
 
+				// Note: This must happen before the data channel opens
+				conn.fragment.Store(msg.SDP.Fragment)
+
 				err := peerConnection.SetRemoteDescription(sdp)
 				if err != nil {
 					logger.Error().
@@ -131,7 +540,7 @@ func Dial(address string, tlsConfig *tls.Config, ordered bool, iceServers []stri
 						sigMsg := signalMsg{
 							Candidate: &candidateMsg{c.ToJSON()},
 						}
-						err := sendMsg(wSock, sigMsg)
+						err := sendMsg(signalCtx, signaler, sigMsg)
 						if err != nil {
 							logger.Error().
 								Err(err).
@@ -144,6 +553,20 @@ func Dial(address string, tlsConfig *tls.Config, ordered bool, iceServers []stri
 					candidatesMux.Unlock()
 				}
 
+			} else if msg.HelloReply != nil {
+				trace("Dial: HelloReplyMsg")
+				if !msg.HelloReply.Accept {
+					conn.pushErrorData(&HelloRejectedError{msg.HelloReply.Payload})
+					return
+				}
+				helloReplies <- msg.HelloReply.Payload
+			} else if msg.VersionReply != nil {
+				trace("Dial: VersionReplyMsg")
+				err := checkVersionReply(msg.VersionReply)
+				if err != nil {
+					conn.pushErrorData(err)
+					return
+				}
 			} else if msg.Candidate != nil {
 				trace("Dial: RtcCandidateMsg")
 				err := peerConnection.AddICECandidate(msg.Candidate.CandidateInit)
@@ -156,26 +579,64 @@ func Dial(address string, tlsConfig *tls.Config, ordered bool, iceServers []stri
 				}
 			} else {
 				// Warning: no valid message included
-				trace("Dial: ws received unknown message " + string(buf[:n]))
+				trace("Dial: received unknown message " + string(dat))
 				continue
 			}
 		}
 	}()
 
-	// Create a datachannel with label 'data'
-	// maxRetransmits := uint16(0)
-	dataChannelOptions := webrtc.DataChannelInit{
-		Ordered: &ordered,
-    // MaxRetransmits: &maxRetransmits,
+	// Create the primary datachannel with label 'data', followed by any additional channels
+	channels := append([]ChannelConfig{config.primaryChannel()}, config.Channels...)
+	if config.PacketChannel {
+		channels = append(channels, packetChannelConfig())
 	}
-	dataChannel, err := peerConnection.CreateDataChannel("data", &dataChannelOptions)
-	if err != nil {
-		logger.Error().
-			Err(err).
-			Msg("Dial: CreateDataChannel")
-		return nil, err
+	labels := make(map[string]bool)
+	for _, chanConfig := range channels {
+		if labels[chanConfig.Label] {
+			return nil, fmt.Errorf("duplicate data channel label: %s", chanConfig.Label)
+		}
+		labels[chanConfig.Label] = true
 	}
 
+	var openMux sync.Mutex
+	numOpen := 0
+	for i, chanConfig := range channels {
+		dataChannel, err := peerConnection.CreateDataChannel(chanConfig.Label, chanConfig.dataChannelInit())
+		if err != nil {
+			logger.Error().
+				Err(err).
+				Msg("Dial: CreateDataChannel")
+			return nil, err
+		}
+
+		// Register channel opening handling
+		isPrimary := (i == 0)
+		dataChannel.OnOpen(func() {
+			printDataChannel(dataChannel)
+			trace("Dial: Data Channel OnOpen")
+
+			detached, err := dataChannel.Detach()
+			if err != nil {
+				conn.pushErrorData(err)
+				return
+			}
+
+			openMux.Lock()
+			defer openMux.Unlock()
+			if isPrimary {
+				conn.dataChannel = dataChannel
+				conn.setRaw(detached)
+			} else {
+				conn.addChannel(dataChannel, detached)
+			}
+
+			// Only finish once every channel is open
+			numOpen++
+			if numOpen == len(channels) {
+				connFinish <- true
+			}
+		})
+	}
 
 	// Set the handler for Peer connection state
 	// This will notify you when the peer has connected/disconnected
@@ -203,21 +664,6 @@ func Dial(address string, tlsConfig *tls.Config, ordered bool, iceServers []stri
 		}
 	})
 
-	// Register channel opening handling
-	dataChannel.OnOpen(func() {
-		printDataChannel(dataChannel)
-		trace("Dial: Data Channel OnOpen")
-
-		detached, err := dataChannel.Detach()
-		if err != nil {
-			conn.pushErrorData(err)
-		} else {
-			conn.raw = detached
-			conn.dataChannel = dataChannel
-			connFinish <- true
-		}
-	})
-
 	// Note: Stopped using this now that I have detached data channels
 	// // Register text message handling
 	// dataChannel.OnMessage(func(msg webrtc.DataChannelMessage) {
@@ -239,6 +685,9 @@ func Dial(address string, tlsConfig *tls.Config, ordered bool, iceServers []stri
 	}
 	// fmt.Println("CreateOffer")
 
+	// Note: The promise must be created before gathering starts
+	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
+
 	// Sets the LocalDescription, and starts our UDP listeners
 	// Note: this will start the gathering of ICE candidates
 	err = peerConnection.SetLocalDescription(offer)
@@ -250,10 +699,19 @@ func Dial(address string, tlsConfig *tls.Config, ordered bool, iceServers []stri
 	}
 	// fmt.Println("SetLocalDesc")
 
+	if noTrickle {
+		select {
+		case <-gatherComplete:
+			offer = *peerConnection.LocalDescription()
+		case <-dialCtx.Done():
+			return nil, dialCtx.Err()
+		}
+	}
+
 	sigMsg := signalMsg{
-		SDP: &sdpMsg{ offer.Type, offer.SDP },
+		SDP: &sdpMsg{ offer.Type, offer.SDP, channelLabels(channels[1:]), config.primaryChannel().reliable(), noTrickle, !config.primaryChannel().reliable() },
 	}
-	err = sendMsg(wSock, sigMsg)
+	err = sendMsg(signalCtx, signaler, sigMsg)
 	if err != nil {
 		logger.Error().
 			Err(err).
@@ -276,31 +734,58 @@ func Dial(address string, tlsConfig *tls.Config, ordered bool, iceServers []stri
 	case <-connFinish:
 		trace("Dial: normal exit")
 		// Socket finished getting setup
+		success = true
+		select {
+		case conn.helloReply = <-helloReplies:
+		default:
+		}
 		return conn, nil
 	}
 }
 
-func sendMsg(conn net.Conn, msg signalMsg) error {
-	// log.Print("sendMsg: ", msg)
-	msgDat, err := json.Marshal(msg)
+// Returned when the dialer has a hello payload, but the listener doesn't support hellos
+var errHelloUnsupported = errors.New("rtcnet: listener doesn't support hello payloads")
+
+// Sends the hello payload to the listener and waits for its reply. Returns a HelloRejectedError if the listener rejected us
+func exchangeHello(ctx context.Context, signaler Signaler, payload []byte) (*helloReplyMsg, error) {
+	err := sendMsg(ctx, signaler, signalMsg{
+		Hello: &helloMsg{payload},
+	})
 	if err != nil {
-		logger.Error().
-			Err(err).
-			Msg("sendMsg: Marshal")
-		return err
+		return nil, err
 	}
 
-	// log.Print("sendMsg: Marshalled: ", string(msgDat))
+	for {
+		dat, err := signaler.Receive(ctx)
+		if err != nil {
+			return nil, err
+		}
 
-	_, err = conn.Write(msgDat)
-	if err != nil {
-		logger.Error().
-			Err(err).
-			Msg("sendMsg: conn write")
-		return err
-	}
+		var msg signalMsg
+		err = json.Unmarshal(dat, &msg)
+		if err != nil {
+			return nil, err
+		}
+		if msg.VersionReply != nil {
+			err := checkVersionReply(msg.VersionReply)
+			if err != nil {
+				return nil, err
+			}
+			if !slices.Contains(msg.VersionReply.Capabilities, capabilityHello) {
+				return nil, errHelloUnsupported
+			}
+			continue
+		}
+		if msg.HelloReply == nil {
+			trace("Dial: received unknown message while waiting for hello reply " + string(dat))
+			continue
+		}
 
-	return nil
+		if !msg.HelloReply.Accept {
+			return nil, &HelloRejectedError{msg.HelloReply.Payload}
+		}
+		return msg.HelloReply, nil
+	}
 }
 
 func printDataChannel(d *webrtc.DataChannel) {
@@ -0,0 +1,81 @@
+package rtcnet
+
+import (
+	"errors"
+)
+
+// Fragmentation lets messages that are larger than the max message size of the transport be sent. When it is enabled, every message on the wire is prefixed with a one byte header that says whether more fragments of the same message follow. The receiving side reassembles the fragments back into the original message.
+// Fragmentation is only enabled when both sides agree to it during negotiation, and only on reliable, ordered transports. On the websocket fallback it is negotiated through the websocket subprotocol, and for webrtc it is negotiated in the SDP signalling messages.
+
+// The websocket subprotocol that is used to negotiate fragmentation on the websocket fallback
+const fragmentSubprotocol = "rtcnet-fragment"
+
+const fragmentHeaderSize = 1
+
+const (
+	fragmentFinal byte = 0 // The final (or only) fragment of a message
+	fragmentMore byte = 1 // More fragments of this message follow
+)
+
+// The largest message that will be reassembled from fragments. This stops a peer from forcing us to buffer an unbounded amount of data
+const maxReassembledMessageSize = 32 * 1024 * 1024
+
+var ErrMessageTooLarge = errors.New("rtcnet: reassembled message is too large")
+var errInvalidFragment = errors.New("rtcnet: received invalid message fragment")
+
+// Reassembles fragmented messages as they are read off of the raw transport
+type reassembler struct {
+	partial []byte
+}
+
+// Adds a raw fragment. Returns the completed message and true once the final fragment is received
+func (r *reassembler) add(fragment []byte) ([]byte, bool, error) {
+	if len(fragment) < fragmentHeaderSize {
+		return nil, false, errInvalidFragment
+	}
+
+	header := fragment[0]
+	payload := fragment[fragmentHeaderSize:]
+	if len(r.partial) + len(payload) > maxReassembledMessageSize {
+		return nil, false, ErrMessageTooLarge
+	}
+
+	switch header {
+	case fragmentFinal:
+		msg := append(r.partial, payload...)
+		if msg == nil {
+			msg = []byte{}
+		}
+		r.partial = nil
+		return msg, true, nil
+	case fragmentMore:
+		r.partial = append(r.partial, payload...)
+		return nil, false, nil
+	}
+	return nil, false, errInvalidFragment
+}
+
+// Splits b into fragments of at most fragmentSize bytes (including the header) and calls write for each of them
+func writeFragments(b []byte, fragmentSize int, write func([]byte) error) error {
+	payloadSize := fragmentSize - fragmentHeaderSize
+	fragment := make([]byte, 0, min(len(b), payloadSize) + fragmentHeaderSize)
+	for {
+		n := min(len(b), payloadSize)
+		header := fragmentMore
+		if n == len(b) {
+			header = fragmentFinal
+		}
+
+		fragment = append(fragment[:0], header)
+		fragment = append(fragment, b[:n]...)
+		err := write(fragment)
+		if err != nil {
+			return err
+		}
+
+		b = b[n:]
+		if header == fragmentFinal {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package rtcnet
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+)
+
+// The largest request or response body of HTTP signalling
+const maxHttpSignalSize = 64 * 1024
+
+// Returned if something is sent after the HTTP signalling request was already made
+var errHttpSignalFinished = errors.New("rtcnet: http signalling already finished")
+
+// Returns true if the signalling message holds an SDP offer or answer
+func isSdpMsg(msg []byte) bool {
+	var m signalMsg
+	err := json.Unmarshal(msg, &m)
+	return err == nil && m.SDP != nil
+}
+
+// Returns the http url of the address, see websocketUrl
+func httpSignalUrl(address string, plaintext bool) (string, error) {
+	wsUrl, err := websocketUrl(address, "", plaintext)
+	if err != nil {
+		return "", err
+	}
+	return strings.Replace(wsUrl, "ws", "http", 1), nil // Note: ws:// becomes http:// and wss:// becomes https://
+}
+
+// --------------------------------------------------------------------------------
+// - Dial
+// --------------------------------------------------------------------------------
+// Signals over a single HTTP request, like WHIP, which posts every message once the SDP offer is sent
+type httpDialSignaler struct {
+	client *http.Client
+	url string
+	header http.Header
+
+	mux sync.Mutex
+	outbox []json.RawMessage
+	posted bool
+	replies []json.RawMessage
+	responded chan struct{} // Closed once the replies are set
+}
+
+func newHttpDialSignaler(address string, config DialConfig) (*httpDialSignaler, error) {
+	url, err := httpSignalUrl(address, config.Plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return &httpDialSignaler{
+		client: newHttpClient(config.TlsConfig),
+		url: url,
+		header: config.Header,
+		responded: make(chan struct{}),
+	}, nil
+}
+
+func (s *httpDialSignaler) Send(ctx context.Context, msg []byte) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.posted {
+		return errHttpSignalFinished
+	}
+
+	s.outbox = append(s.outbox, json.RawMessage(msg))
+	if !isSdpMsg(msg) {
+		return nil
+	}
+
+	s.posted = true
+	replies, err := s.post(ctx)
+	if err != nil {
+		return err
+	}
+	s.replies = replies
+	close(s.responded)
+	return nil
+}
+
+func (s *httpDialSignaler) Receive(ctx context.Context) ([]byte, error) {
+	select {
+	case <-s.responded:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	s.mux.Lock()
+	if len(s.replies) > 0 {
+		reply := s.replies[0]
+		s.replies = s.replies[1:]
+		s.mux.Unlock()
+		return reply, nil
+	}
+	s.mux.Unlock()
+
+	// Note: The listener won't send anything else, so just wait until the negotiation is over
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (s *httpDialSignaler) post(ctx context.Context) ([]json.RawMessage, error) {
+	body, err := json.Marshal(s.outbox)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if s.header != nil {
+		req.Header = s.header.Clone()
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	dat, err := io.ReadAll(io.LimitReader(resp.Body, maxHttpSignalSize))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("rtcnet: http signalling failed (%d): %s", resp.StatusCode, strings.TrimSpace(string(dat)))
+	}
+
+	var replies []json.RawMessage
+	err = json.Unmarshal(dat, &replies)
+	if err != nil {
+		return nil, err
+	}
+	return replies, nil
+}
+
+// --------------------------------------------------------------------------------
+// - Listener
+// --------------------------------------------------------------------------------
+// The listening side of HTTP signalling, which writes every message to the response once the SDP answer is sent
+type httpAcceptSignaler struct {
+	requests chan []byte
+	localAddr, remoteAddr net.Addr
+
+	mux sync.Mutex
+	replies []json.RawMessage
+	finished bool
+	done chan struct{} // Closed once the replies are ready to be written
+}
+
+func newHttpAcceptSignaler(requests []json.RawMessage, localAddr, remoteAddr net.Addr) *httpAcceptSignaler {
+	s := &httpAcceptSignaler{
+		requests: make(chan []byte, len(requests)),
+		localAddr: localAddr,
+		remoteAddr: remoteAddr,
+		done: make(chan struct{}),
+	}
+	for _, msg := range requests {
+		s.requests <- msg
+	}
+	return s
+}
+
+func (s *httpAcceptSignaler) Send(ctx context.Context, msg []byte) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.finished {
+		return errHttpSignalFinished
+	}
+
+	s.replies = append(s.replies, json.RawMessage(msg))
+	if isSdpMsg(msg) {
+		s.finish()
+	}
+	return nil
+}
+
+// Note: Returns io.EOF once every message of the request was received, because the dialer can't send anything else
+func (s *httpAcceptSignaler) Receive(ctx context.Context) ([]byte, error) {
+	select {
+	case msg := <-s.requests:
+		return msg, nil
+	default:
+		return nil, io.EOF
+	}
+}
+
+func (s *httpAcceptSignaler) LocalAddr() net.Addr {
+	return s.localAddr
+}
+
+func (s *httpAcceptSignaler) RemoteAddr() net.Addr {
+	return s.remoteAddr
+}
+
+// Ends the signalling, so that the response gets written with whatever was sent so far
+func (s *httpAcceptSignaler) Close() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.finish()
+	return nil
+}
+
+func (s *httpAcceptSignaler) finish() {
+	if s.finished { return }
+	s.finished = true
+	close(s.done)
+}
+
+// Negotiates webrtc over a single HTTP request, see DialConfig.HttpSignalling
+func (l *websocketListener) serveHttpSignalling(w http.ResponseWriter, r *http.Request, identity any) {
+	// Note: Unlike a websocket upgrade, a cross origin post is sent without the permission of the listener
+	err := authenticateOrigin(r, l.originPatterns)
+	if err != nil {
+		logger.Debug().
+			Err(err).
+			Str("RemoteAddr", r.RemoteAddr).
+			Msg("Listener: rejected http signalling origin")
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	setCorsHeaders(w, r)
+
+	// Note: Requiring json means that a browser always has to preflight a cross origin request, so plain html forms can't post signalling
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		http.Error(w, "signalling requests must be application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var requests []json.RawMessage
+	err = json.NewDecoder(http.MaxBytesReader(w, r.Body, maxHttpSignalSize)).Decode(&requests)
+	if err != nil {
+		http.Error(w, "invalid signalling request", http.StatusBadRequest)
+		return
+	}
+
+	localAddr, remoteAddr := requestAddrs(r)
+	signaler := newHttpAcceptSignaler(requests, localAddr, remoteAddr)
+	l.pushAccept(&signalConn{signaler, signaler, newMetadata(r, identity), ""})
+
+	select {
+	case <-signaler.done:
+	case <-r.Context().Done():
+		return // The dialer gave up
+	}
+
+	signaler.mux.Lock()
+	replies := signaler.replies
+	signaler.mux.Unlock()
+	if len(replies) == 0 {
+		http.Error(w, "webrtc negotiation failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(replies)
+}
+
+// Answers the CORS preflight that browsers send before posting signalling from another origin
+func (l *websocketListener) serveHttpPreflight(w http.ResponseWriter, r *http.Request) {
+	err := authenticateOrigin(r, l.originPatterns)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	setCorsHeaders(w, r)
+	if r.Header.Get("Origin") != "" {
+		w.Header().Set("Access-Control-Allow-Methods", http.MethodPost)
+		w.Header().Set("Access-Control-Allow-Headers", r.Header.Get("Access-Control-Request-Headers")) // Note: Allows the headers of DialConfig.Header, which are already checked by ListenConfig.Authenticate
+		w.Header().Set("Access-Control-Max-Age", "600")
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Lets the browser hand the response to the origin of the request. The origin must already be authenticated
+func setCorsHeaders(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Vary", "Origin")
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return // Not a browser request
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("Access-Control-Allow-Credentials", "true") // Note: So that ListenConfig.Authenticate can use cookies
+}
+
+// Returns an error if the origin of the request isn't allowed, like the websocket upgrade does, see ListenConfig.OriginPatterns
+func authenticateOrigin(r *http.Request, originPatterns []string) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil // Note: Browsers always send the origin of cross origin requests, so this isn't a browser on another origin
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return fmt.Errorf("rtcnet: failed to parse origin %q: %w", origin, err)
+	}
+	if strings.EqualFold(r.Host, u.Host) {
+		return nil
+	}
+	for _, pattern := range originPatterns {
+		matched, err := path.Match(strings.ToLower(pattern), strings.ToLower(u.Host))
+		if err != nil {
+			return fmt.Errorf("rtcnet: failed to parse origin pattern %q: %w", pattern, err)
+		}
+		if matched {
+			return nil
+		}
+	}
+	return fmt.Errorf("rtcnet: origin %q is not authorized for host %q", origin, r.Host)
+}
@@ -1,23 +1,103 @@
 package rtcnet
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"net/url"
+	"slices"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/pion/webrtc/v4"
 )
 
 type ListenConfig struct {
 	TlsConfig *tls.Config
+
+	// If true, listen on plain TCP instead of TLS, and TlsConfig is ignored. This should only be used for local development or behind a proxy that terminates TLS, like nginx or envoy. Webrtc data is always encrypted
+	Plaintext bool
+
+	// Host patterns of the origins that browsers may connect from, besides the host of the listener itself, like "example.com" or "*.example.com". They are matched with path.Match. This applies to the websocket upgrade and to HTTP signalling, which also sends CORS headers to these origins
 	OriginPatterns []string
-	IceServers []string
+
+	// Websocket subprotocols of the application that the listener accepts, in order of preference. See Conn.Subprotocol
+	Subprotocols []string
+
+	IceServers []string // STUN or TURN urls that don't need credentials. See Network.IceServers for full ICE server descriptors
+
+	// ICE network settings for accepted peers, like NAT 1:1 IPs and port ranges, so that the listener can run in a container without host networking
+	Network NetworkConfig
+
+	// If set, the ICE traffic of every accepted peer goes through one shared UDP port that is bound to this address, like ":3478" for every interface, instead of each peer binding its own ephemeral ports. Only this one port needs to be opened on firewalls and load balancers. The socket is opened with the listener and closed with it, and Network.PortMin and Network.PortMax are ignored. This only applies to desktop builds
+	UdpMuxAddress string
+
+	// If set, the listener also advertises ICE-TCP passive candidates on this TCP address, like ":3479", which is shared by every accepted peer. Clients on networks that block UDP can then still connect with webrtc over TCP, before resorting to the websocket fallback. Network.NetworkTypes must allow TCP, which it does by default, and so must the NetworkTypes of the dialers. The port is opened with the listener and closed with it. This only applies to desktop builds
+	TcpMuxAddress string
 	// AllowWebsocketFallback bool // TODO: Restriction?
+
+	// If set, this is called with the websocket upgrade request before any webrtc resources are created, so that the request can be authenticated using its headers, query, cookies or remote address. Returning an error rejects the request, with the status of a RejectError or with 403 Forbidden for any other error. The returned identity is attached to the accepted conn, see Conn.Identity
+	Authenticate func(r *http.Request) (identity any, err error)
+
+	// If true, accepted conns have byte stream semantics, like a TCP conn, instead of message semantics. See Conn.Read. Dialers whose primary channel is unordered or unreliable are rejected
+	Stream bool
+
+	// If set, this is called with the hello payload of the dialer (see DialConfig.Hello) before the webrtc offer is answered. The reply payload is sent back to the dialer, and returning false rejects the dialer. Dialers that didn't send a hello are passed a nil payload. Websocket fallback dialers are rejected by closing the websocket with the reply as the close reason, so the reply should be short text, as it is cut down to 123 bytes. This may be called concurrently for different dialers. The accepted payload is attached to the accepted conn, see Metadata.Hello
+	Hello func(metadata *Metadata, payload []byte) (reply []byte, accept bool)
+
+	// If true, the answer is only sent once it contains every ICE candidate, which is always done for dialers that didn't trickle, see DialConfig.NoTrickle
+	NoTrickle bool
+
+	// The oldest signalling protocol version that is accepted, see ProtocolVersion. Every version from this one up to ProtocolVersion is supported at the same time. Dialers with an older version are rejected, and fail to dial with a VersionError. Version 0 is the original unversioned protocol. The websocket fallback is not versioned
+	MinProtocolVersion int
+
+	// If set, the listener mints short-lived TURN credentials for each accepted dialer that asks for ICE servers, see DialConfig.RequestIceServers
+	TurnRest *TurnRestConfig
+}
+
+// Returned by ListenConfig.Authenticate to reject a request with a specific HTTP status
+type RejectError struct {
+	Status int
+	Reason string // Sent to the dialer as the body of the response
+}
+
+func (e *RejectError) Error() string {
+	return fmt.Sprintf("rtcnet: request rejected (%d): %s", e.Status, e.Reason)
+}
+
+// Information about the request that an accepted connection was made with
+type Metadata struct {
+	Path string // The url path, as seen by the handler. For the websocket fallback this ends with "/wss"
+	Query url.Values
+	Header http.Header
+	Host string
+	RemoteAddr string // The remote address of the request. Behind a proxy, this is the address of the proxy, so check the forwarding headers instead
+
+	Identity any // The identity returned by ListenConfig.Authenticate
+	Hello []byte // The hello payload that the dialer sent, see DialConfig.Hello
+
+	ProtocolVersion int // The signalling protocol version that was negotiated with the dialer. This is 0 for the websocket fallback
+	Capabilities []string // The optional signalling features that both peers support
+}
+
+func newMetadata(r *http.Request, identity any) *Metadata {
+	m := &Metadata{
+		Header: r.Header.Clone(),
+		Host: r.Host,
+		RemoteAddr: r.RemoteAddr,
+		Identity: identity,
+	}
+	if r.URL != nil {
+		m.Path = r.URL.Path
+		m.Query = r.URL.Query()
+	}
+	return m
 }
 
 type Listener struct {
@@ -25,45 +105,112 @@ type Listener struct {
 	pendingAccepts chan net.Conn // TODO - should this get buffered?
 	pendingAcceptErrors chan error // TODO - should this get buffered?
 	closed atomic.Bool
-	iceServers []string
+	closeOnce sync.Once
+	closeChan chan struct{}
+	config ListenConfig
+	udpMux, tcpMux io.Closer
+	packetConn *listenerPacketConn
 }
 
+// Starts a TLS server on the address which accepts connections
 func NewListener(address string, config ListenConfig) (*Listener, error) {
+	udpMux, tcpMux, err := listenMuxes(config)
+	if err != nil {
+		return nil, err
+	}
 	wsl, err := newWebsocketListener(address, config)
 	if err != nil {
+		closeMuxes(udpMux, tcpMux)
 		return nil, err
 	}
+	return newListener(wsl, config, udpMux, tcpMux), nil
+}
+
+// Returns a listener that doesn't start its own server. Instead the listener is an http.Handler that can be mounted on an existing server, at any path. Clients dial the mounted path, for example "example.com:443/rtc" if the handler is mounted at "/rtc". The websocket fallback is served from the "/wss" path below the mounted path.
+// Accepted connections are returned by Accept, just like a normal listener. Closing the listener does not close the server that it is mounted on. Note: TlsConfig is unused, because the server that the handler is mounted on handles TLS
+// Returns an error if the UdpMuxAddress or TcpMuxAddress can't be listened on
+func NewHandler(config ListenConfig) (*Listener, error) {
+	udpMux, tcpMux, err := listenMuxes(config)
+	if err != nil {
+		return nil, err
+	}
+	wsl := newWebsocketHandler(wsAddr("http-handler"), config)
+	return newListener(wsl, config, udpMux, tcpMux), nil
+}
+
+// Returns the shared UDP and TCP muxes for the listener. Either is nil if the listener doesn't use it
+func listenMuxes(config ListenConfig) (io.Closer, io.Closer, error) {
+	var udpMux, tcpMux io.Closer
+	var err error
+	if config.UdpMuxAddress != "" {
+		udpMux, err = newUdpMux(config.UdpMuxAddress)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if config.TcpMuxAddress != "" {
+		tcpMux, err = newTcpMux(config.TcpMuxAddress)
+		if err != nil {
+			closeMuxes(udpMux, nil)
+			return nil, nil, err
+		}
+	}
+	return udpMux, tcpMux, nil
+}
 
+// Closes the muxes that were opened, and returns the combined error
+func closeMuxes(muxes ...io.Closer) error {
+	var err error
+	for _, mux := range muxes {
+		if mux == nil { continue }
+		err = errors.Join(err, mux.Close())
+	}
+	return err
+}
+
+func newListener(wsl *websocketListener, config ListenConfig, udpMux, tcpMux io.Closer) *Listener {
+	config.Network.udpMux = udpMux
+	config.Network.tcpMux = tcpMux
 	rtcListener := &Listener{
 		wsListener: wsl,
 		pendingAccepts: make(chan net.Conn),
 		pendingAcceptErrors: make(chan error),
-		iceServers: config.IceServers,
+		closeChan: make(chan struct{}),
+		config: config,
+		udpMux: udpMux,
+		tcpMux: tcpMux,
+		packetConn: newListenerPacketConn(wsl.Addr()),
 	}
 
 	go func() {
 		for {
 			wsConn, err := rtcListener.wsListener.Accept()
-			if err != nil {
-				rtcListener.pendingAcceptErrors <- err
-				continue
-			}
-
 			if rtcListener.closed.Load() {
 				return // If closed then just exit
 			}
+			if err != nil {
+				rtcListener.pushAcceptError(err)
+				continue
+			}
 
-			fallback, isFallback := wsConn.(wsFallback)
-			if isFallback {
-				rtcListener.pendingAccepts <- fallback.Conn
-			} else {
+			switch accepted := wsConn.(type) {
+			case *Conn:
+				// The dialer is using the websocket fallback
+				accepted.stream = rtcListener.config.Stream
+				go rtcListener.acceptFallback(accepted)
+			case *signalConn:
 				// Try and negotiate a webrtc connection for the websocket connection
-				go rtcListener.attemptWebRtcNegotiation(wsConn)
+				go rtcListener.attemptWebRtcNegotiation(accepted)
 			}
 		}
 	}()
 
-	return rtcListener, nil
+	return rtcListener
+}
+
+// Accepts websocket connections for signalling and for the websocket fallback. This is only needed if the listener was created with NewHandler
+func (l *Listener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l.wsListener.ServeHTTP(w, r)
 }
 
 func (l *Listener) Accept() (net.Conn, error) {
@@ -72,59 +219,269 @@ func (l *Listener) Accept() (net.Conn, error) {
 		return conn, nil
 	case err := <-l.pendingAcceptErrors:
 		return nil, err
+	case <-l.closeChan:
+		return nil, net.ErrClosed
 	}
 }
 func (l *Listener) Close() error {
-	l.closed.Store(true)
-	// TODO: these aren't channel safe. need to do a boolean check before writing to them.
-	close(l.pendingAccepts)
-	close(l.pendingAcceptErrors)
+	var err error
+	l.closeOnce.Do(func() {
+		l.closed.Store(true)
+		close(l.closeChan)
+		l.packetConn.Close()
+
+		err = l.wsListener.Close()
+		err = errors.Join(err, closeMuxes(l.udpMux, l.tcpMux))
+	})
+	return err
+}
+
+// Hands the conn to Accept. If the listener is closed, then the conn is closed instead
+func (l *Listener) pushAccept(conn net.Conn) {
+	select {
+	case l.pendingAccepts <- conn:
+	case <-l.closeChan:
+		conn.Close()
+	}
+}
+
+// Hands the error to Accept. If the listener is closed, then the error is dropped
+func (l *Listener) pushAcceptError(err error) {
+	select {
+	case l.pendingAcceptErrors <- err:
+	case <-l.closeChan:
+	}
+}
 
-	return l.wsListener.Close()
+// Returns a net.PacketConn that reads packets from, and writes packets to, every accepted peer that was dialed with DialConfig.PacketChannel. Peers are addressed by a PeerAddr, which is unique to each accepted conn, see Conn.PacketAddr. Peers that use the websocket fallback can't be reached through it
+func (l *Listener) PacketConn() net.PacketConn {
+	return l.packetConn
 }
 func (l *Listener) Addr() net.Addr {
 	return l.wsListener.Addr()
 }
 
-func (l *Listener) attemptWebRtcNegotiation(wsConn net.Conn) {
+// Negotiates webrtc over the signalling websocket or HTTP request, and hands the conn to Accept
+func (l *Listener) attemptWebRtcNegotiation(signal *signalConn) {
 	defer trace("finished attemptWebRtcNegotiation")
+	defer signal.Close()
 
-	localAddr := wsConn.LocalAddr()
-	remoteAddr := wsConn.RemoteAddr()
+	// TODO: make timeout configurable?
+	ctx, cancel := context.WithTimeout(context.Background(), 30 * time.Second)
+	defer cancel()
 
-	api := getSettingsEngineApi()
+	conn, err := acceptWebRtc(ctx, signal.Signaler, l.config, signal.metadata)
+	if err != nil {
+		if wSock, ok := signal.Signaler.(*wsSignaler); ok && isRejected(err) {
+			wSock.reject(err.Error())
+		}
+		if errors.Is(err, errDialerFailed) {
+			logger.Debug().
+				Err(err).
+				Str("RemoteAddr", signal.metadata.RemoteAddr).
+				Msg("Listener: webrtc negotiation failed")
+			return
+		}
+		l.pushAcceptError(err)
+		return
+	}
 
-	var candidatesMux sync.Mutex
-	pendingCandidates := make([]*webrtc.ICECandidate, 0)
-	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			// {
-			// 	URLs: l.iceServers,
-			// },
-			// {
-			// 	URLs: []string{"stun:stun.l.google.com:19302"},
-			// },
-		},
-	}
-	if len(l.iceServers) > 0 {
-		config.ICEServers = append(config.ICEServers,
-			webrtc.ICEServer{
-				URLs: l.iceServers,
+	conn.subprotocol = signal.subprotocol
+	if packetChannel := conn.Channel(packetChannelLabel); packetChannel != nil {
+		addr := l.packetConn.addPeer(packetChannel)
+		conn.packetAddr = &addr
+	}
+	l.pushAccept(conn)
+}
+
+// Replies to the version msg of the dialer, which is nil if the dialer predates versioning. Returns a VersionError if the dialer was rejected
+func negotiateVersion(ctx context.Context, signaler Signaler, config ListenConfig, metadata *Metadata, msg *versionMsg) error {
+	version := 0
+	var dialerCapabilities []string
+	if msg != nil {
+		version = msg.Version
+		dialerCapabilities = msg.Capabilities
+	}
+	if version > ProtocolVersion {
+		version = ProtocolVersion // Note: Newer dialers are expected to support older listeners
+	}
+
+	accept := version >= config.MinProtocolVersion
+	metadata.ProtocolVersion = version
+	metadata.Capabilities = intersectCapabilities(capabilities, dialerCapabilities)
+	if !accept {
+		logger.Warn().
+			Int("Version", version).
+			Int("MinVersion", config.MinProtocolVersion).
+			Str("RemoteAddr", metadata.RemoteAddr).
+			Msg("Listener: rejecting dialer with an old protocol version")
+	}
+
+	err := sendMsg(ctx, signaler, signalMsg{
+		VersionReply: &versionReplyMsg{accept, version, config.MinProtocolVersion, metadata.Capabilities},
+	})
+	if err != nil {
+		logger.Error().
+			Err(err).
+			Msg("Listener: Send Version Reply")
+		return err
+	}
+	if !accept {
+		// Note: Dialers that predate versioning ignore the reply, but fail as soon as they can't apply an answer
+		if msg == nil {
+			sendMsg(ctx, signaler, signalMsg{
+				SDP: &sdpMsg{Type: webrtc.SDPTypeAnswer},
 			})
+		}
+		return &VersionError{version, config.MinProtocolVersion}
+	}
+	return nil
+}
+
+// Exchanges the hello with a websocket fallback dialer, see helloSubprotocol, and accepts the conn if the hello hook accepts it
+func (l *Listener) acceptFallback(conn *Conn) {
+	transport := conn.raw.(*wsTransport)
+	sentHello := transport.sendsHello
+	if l.config.Hello == nil && !sentHello {
+		l.pushAccept(conn)
+		return
+	}
+
+	var payload []byte
+	if sentHello {
+		// Note: Don't let a dialer that never sends its hello hold the conn open forever
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		var err error
+		payload, err = conn.ReadMessage()
+		conn.SetReadDeadline(time.Time{})
+		if err == nil && len(payload) > maxHelloSize {
+			err = fmt.Errorf("rtcnet: hello payload is larger than %d bytes", maxHelloSize)
+		}
+		if err != nil {
+			logger.Debug().
+				Err(err).
+				Msg("Listener: Read Fallback Hello")
+			conn.Close()
+			return
+		}
+	}
+
+	reply, accept := []byte(nil), true
+	if l.config.Hello != nil {
+		reply, accept = l.config.Hello(conn.metadata, payload)
+	}
+	if !accept {
+		logger.Debug().
+			Str("RemoteAddr", conn.metadata.RemoteAddr).
+			Msg("Listener: Rejected Fallback Hello")
+		transport.reject(reply)
+		conn.Close()
+		return
+	}
+	conn.metadata.Hello = payload
+
+	if sentHello {
+		err := conn.WriteMessage(reply)
+		if err != nil {
+			logger.Debug().
+				Err(err).
+				Msg("Listener: Send Fallback Hello Reply")
+			conn.Close()
+			return
+		}
+	}
+	l.pushAccept(conn)
+}
+
+// Runs the hello hook for the payload, and sends the result back to the dialer if reply is true. Returns a HelloRejectedError if the dialer was rejected
+func handleHello(ctx context.Context, signaler Signaler, config ListenConfig, metadata *Metadata, payload []byte, reply bool) error {
+	if len(payload) > maxHelloSize {
+		return fmt.Errorf("rtcnet: hello payload is larger than %d bytes", maxHelloSize)
+	}
+
+	replyPayload, accept := []byte(nil), true
+	if config.Hello != nil {
+		replyPayload, accept = config.Hello(metadata, payload)
+	}
+	if accept {
+		metadata.Hello = payload
+	}
+
+	// Note: Credentials are only minted for accepted dialers, so that rejected dialers can't use the TURN servers
+	var iceServers []iceServerMsg
+	if reply && accept && config.TurnRest != nil && slices.Contains(metadata.Capabilities, capabilityIceServers) {
+		iceServers = config.TurnRest.iceServers(metadata, time.Now())
+	}
+
+	if reply {
+		err := sendMsg(ctx, signaler, signalMsg{
+			HelloReply: &helloReplyMsg{accept, replyPayload, iceServers},
+		})
+		if err != nil {
+			logger.Error().
+				Err(err).
+				Msg("Listener: Send Hello Reply")
+			return err
+		}
+	}
+	if !accept {
+		return &HelloRejectedError{replyPayload}
+	}
+	return nil
+}
+
+// Wraps the errors of negotiations that failed because of the dialer, so that one bad dialer can't make Accept return an error
+var errDialerFailed = errors.New("rtcnet: dialer failed")
+
+// Negotiates a webrtc connection with the dialer on the other end of the signaler. Any pending webrtc state is torn down if the context is cancelled before the connection finishes getting setup
+func acceptWebRtc(ctx context.Context, signaler Signaler, listenConfig ListenConfig, metadata *Metadata) (*Conn, error) {
+	// Note: Cancelled when we return, so that the signalling goroutine stops reading from the signaler
+	signalCtx, signalCancel := context.WithCancel(ctx)
+	defer signalCancel()
+
+	localAddr, remoteAddr := signalerAddrs(signaler)
+
+	api, err := getSettingsEngineApi(listenConfig.Network)
+	if err != nil {
+		return nil, err
 	}
 
+	var candidatesMux sync.Mutex
+	pendingCandidates := make([]*webrtc.ICECandidate, 0)
+	config := getRtcConfiguration(listenConfig.IceServers, listenConfig.Network)
+
 	peerConnection, err := api.NewPeerConnection(config)
 	if err != nil {
-		l.pendingAcceptErrors <- err
-		return
+		return nil, err
 	}
 
+	// Every data channel of the peer is gathered into one conn. It is accepted once the primary channel and all of the additional channels that the dialer asked for are open
+	conn := newConn(peerConnection, localAddr, remoteAddr)
+	conn.stream = listenConfig.Stream
+	conn.metadata = metadata
+	connFinish := make(chan bool, 1) // Note: Buffered so that OnOpen doesn't block if we have already given up on the negotiation
+
+	// If we fail to finish negotiating for any reason, then tear down the pending peer connection
+	success := false
+	defer func() {
+		if !success {
+			conn.Close()
+		}
+	}()
+
 	// When an ICE candidate is available send to the other Pion instance
 	// the other Pion instance will add this candidate by calling AddICECandidate
+	var noTrickle atomic.Bool
 	peerConnection.OnICECandidate(func(c *webrtc.ICECandidate) {
 		if c == nil {
 			return // Do nothing because the ice candidate was nil for some reason
 		}
+		if signalCtx.Err() != nil {
+			return // The negotiation is over, so there is no one to send the candidate to
+		}
+		if noTrickle.Load() {
+			return // The candidates are sent in the answer instead
+		}
 
 		// logger.Trace().
 		// 	Str("Address", c.Address).
@@ -146,9 +503,9 @@ func (l *Listener) attemptWebRtcNegotiation(wsConn net.Conn) {
 				Candidate: &candidateMsg{c.ToJSON()},
 			}
 
-			err := sendMsg(wsConn, sigMsg)
+			err := sendMsg(signalCtx, signaler, sigMsg)
 			if err != nil {
-				l.pendingAcceptErrors <- fmt.Errorf("OnIceCandidate Send - Possible websocket disconnect: %w", err)
+				conn.pushErrorData(fmt.Errorf("OnIceCandidate Send - Possible signaler disconnect: %w", err))
 				return
 			}
 		}
@@ -179,22 +536,44 @@ func (l *Listener) attemptWebRtcNegotiation(wsConn net.Conn) {
 		}
 	})
 
+	var channelsMux sync.Mutex
+	var expectedChannels []string
+	primaryOpen := false
+	accepted := false
+
 	// Register data channel creation handling
 	peerConnection.OnDataChannel(func(d *webrtc.DataChannel) {
-		conn := newConn(peerConnection, localAddr, remoteAddr)
-		conn.dataChannel = d
-
 		// Register channel opening handling
 		d.OnOpen(func() {
 			printDataChannel(d)
-			wsConn.Close()
 
-			var err error
-			conn.raw, err = d.Detach()
+			raw, err := d.Detach()
 			if err != nil {
-				l.pendingAcceptErrors <- err
+				conn.pushErrorData(err)
+				return
+			}
+
+			if d.Label() == primaryChannelLabel && conn.stream && !isReliable(d) {
+				conn.pushErrorData(errStreamUnreliable)
+				return
+			}
+
+			channelsMux.Lock()
+			if d.Label() == primaryChannelLabel {
+				conn.dataChannel = d
+				conn.setRaw(raw)
+				primaryOpen = true
 			} else {
-				l.pendingAccepts <- conn
+				conn.addChannel(d, raw)
+			}
+			ready := !accepted && primaryOpen && conn.numChannels() >= len(expectedChannels)
+			if ready {
+				accepted = true
+			}
+			channelsMux.Unlock()
+
+			if ready {
+				connFinish <- true
 			}
 		})
 
@@ -215,106 +594,197 @@ func (l *Listener) attemptWebRtcNegotiation(wsConn net.Conn) {
 		// })
 	})
 
-	buf := make([]byte, 8 * 1024) // TODO: hardcoded to be big enough for the signalling messages
-	for {
-		n, err := wsConn.Read(buf)
-		if err != nil {
-			if !errors.Is(err, io.EOF) {
-				logger.Error().
-					Err(err).
-					Msg("error reading websocket")
-			}
-			// Assume the websocket is closed and break
-			break
-		}
-
-		if n == 0 { continue }
-
-		var msg signalMsg
-		err = json.Unmarshal(buf[:n], &msg)
-		if err != nil {
-			// There was some problem with the unmarshal. Let's just continue looking for another valid message
-			continue
-		}
-
-		if msg.SDP != nil {
-			trace("Listener: RtcSdpMsg")
-			sdp := webrtc.SessionDescription{}
-			sdp.Type = msg.SDP.Type
-			sdp.SDP = msg.SDP.SDP
-
-			err := peerConnection.SetRemoteDescription(sdp)
+	go func() {
+		versionDone := false
+		helloDone := false
+		for {
+			dat, err := signaler.Receive(signalCtx)
 			if err != nil {
-				logger.Error().
-					Err(err).
-					Msg("Listener: SetRemoteDescription")
-				l.pendingAcceptErrors <- fmt.Errorf("RtcSdpMsg Recv - Failed to set remote description: %w", err)
-				return
-			}
+				if signalCtx.Err() != nil {
+					return // The negotiation is over
+				}
+				if !errors.Is(err, io.EOF) {
+					logger.Error().
+						Err(err).
+						Msg("error receiving from signaler")
+				}
 
-			// Create an answer to send to the other process
-			answer, err := peerConnection.CreateAnswer(nil)
-			if err != nil {
-				logger.Error().
-					Err(err).
-					Msg("Listener: CreateAnswer")
-				l.pendingAcceptErrors <- fmt.Errorf("RtcSdpMsg Recv - Failed to create answer: %w", err)
+				// Note: Once the offer is answered, the connection can still finish with the candidates that were already exchanged
+				if peerConnection.RemoteDescription() == nil {
+					conn.pushErrorData(fmt.Errorf("%w: %w", errSignalClosed, err))
+				}
+				// Assume the signaler is closed and break
 				return
 			}
 
-			sigMsg := signalMsg{
-				SDP: &sdpMsg{ answer.Type, answer.SDP },
-			}
-			err = sendMsg(wsConn, sigMsg)
+			if len(dat) == 0 { continue }
+
+			var msg signalMsg
+			err = json.Unmarshal(dat, &msg)
 			if err != nil {
-				logger.Error().
-					Err(err).
-					Msg("Listener: Websocket Send Answer")
-				l.pendingAcceptErrors <- fmt.Errorf("RtcSdpMsg Recv - Failed to send SDP answer: %w", err)
-				return
+				// There was some problem with the unmarshal. Let's just continue looking for another valid message
+				continue
 			}
 
-			// Sets the LocalDescription, and starts our UDP listeners
-			err = peerConnection.SetLocalDescription(answer)
-			if err != nil {
-				logger.Error().
-					Err(err).
-					Msg("Listener: SetLocalDescription")
-				l.pendingAcceptErrors <- fmt.Errorf("RtcSdpMsg Recv - Failed to set local SDP: %w", err)
-				return
+			// Note: The version is always negotiated first. If the first message isn't a version, then the dialer predates versioning
+			if !versionDone {
+				versionDone = true
+				err := negotiateVersion(signalCtx, signaler, listenConfig, metadata, msg.Version)
+				if err != nil {
+					conn.pushErrorData(err)
+					return
+				}
 			}
 
-			candidatesMux.Lock()
-			for _, c := range pendingCandidates {
-				trace(fmt.Sprintf("Listener: %v", *c))
+			if msg.Version != nil {
+				trace("Listener: VersionMsg")
+				continue
+			} else if msg.Hello != nil {
+				trace("Listener: HelloMsg")
+				if helloDone { continue }
+				helloDone = true
+
+				err := handleHello(signalCtx, signaler, listenConfig, metadata, msg.Hello.Payload, true)
+				if err != nil {
+					conn.pushErrorData(err)
+					return
+				}
+			} else if msg.SDP != nil {
+				trace("Listener: RtcSdpMsg")
+				if !helloDone {
+					// Note: The dialer didn't send a hello, but the hook still gets to decide whether to accept it
+					helloDone = true
+					err := handleHello(signalCtx, signaler, listenConfig, metadata, nil, false)
+					if err != nil {
+						conn.pushErrorData(err)
+						return
+					}
+				}
+
+				// Note: Dialers that predate this flag are checked once their primary channel opens instead
+				if listenConfig.Stream && msg.SDP.Unreliable {
+					conn.pushErrorData(errStreamUnreliable)
+					return
+				}
+
+				channelsMux.Lock()
+				expectedChannels = msg.SDP.Channels
+				channelsMux.Unlock()
+
+				sdp := webrtc.SessionDescription{}
+				sdp.Type = msg.SDP.Type
+				sdp.SDP = msg.SDP.SDP
+
+				err := peerConnection.SetRemoteDescription(sdp)
+				if err != nil {
+					logger.Error().
+						Err(err).
+						Msg("Listener: SetRemoteDescription")
+					conn.pushErrorData(fmt.Errorf("RtcSdpMsg Recv - Failed to set remote description: %w", err))
+					return
+				}
+
+				// Create an answer to send to the other process
+				answer, err := peerConnection.CreateAnswer(nil)
+				if err != nil {
+					logger.Error().
+						Err(err).
+						Msg("Listener: CreateAnswer")
+					conn.pushErrorData(fmt.Errorf("RtcSdpMsg Recv - Failed to create answer: %w", err))
+					return
+				}
+
+				// Note: If the dialer doesn't trickle, then we don't either. Gather every candidate into the answer before sending it
+				answerNoTrickle := msg.SDP.NoTrickle || listenConfig.NoTrickle
+				noTrickle.Store(answerNoTrickle)
+				if answerNoTrickle {
+					// Note: The promise must be created before gathering starts
+					gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
+					err = peerConnection.SetLocalDescription(answer)
+					if err != nil {
+						logger.Error().
+							Err(err).
+							Msg("Listener: SetLocalDescription")
+						conn.pushErrorData(fmt.Errorf("RtcSdpMsg Recv - Failed to set local SDP: %w", err))
+						return
+					}
+
+					select {
+					case <-gatherComplete:
+						answer = *peerConnection.LocalDescription()
+					case <-signalCtx.Done():
+						return
+					}
+				}
+
+				// Note: We always support fragmentation, so confirm it if it was requested
+				conn.fragment.Store(msg.SDP.Fragment)
 				sigMsg := signalMsg{
-					Candidate: &candidateMsg{c.ToJSON()},
+					SDP: &sdpMsg{ answer.Type, answer.SDP, nil, msg.SDP.Fragment, answerNoTrickle, false },
 				}
-				err := sendMsg(wsConn, sigMsg)
+				err = sendMsg(signalCtx, signaler, sigMsg)
 				if err != nil {
 					logger.Error().
 						Err(err).
-						Msg("Listener: Websocket Send Pending Candidate Message")
-					l.pendingAcceptErrors <- fmt.Errorf("RtcSdpMsg Recv - Failed to send RtcCandidate: %w", err)
+						Msg("Listener: Send Answer")
+					conn.pushErrorData(fmt.Errorf("RtcSdpMsg Recv - Failed to send SDP answer: %w", err))
 					return
 				}
+				if answerNoTrickle { continue }
+
+				// Sets the LocalDescription, and starts our UDP listeners
+				err = peerConnection.SetLocalDescription(answer)
+				if err != nil {
+					logger.Error().
+						Err(err).
+						Msg("Listener: SetLocalDescription")
+					conn.pushErrorData(fmt.Errorf("RtcSdpMsg Recv - Failed to set local SDP: %w", err))
+					return
+				}
+
+				candidatesMux.Lock()
+				for _, c := range pendingCandidates {
+					trace(fmt.Sprintf("Listener: %v", *c))
+					sigMsg := signalMsg{
+						Candidate: &candidateMsg{c.ToJSON()},
+					}
+					err := sendMsg(signalCtx, signaler, sigMsg)
+					if err != nil {
+						logger.Error().
+							Err(err).
+							Msg("Listener: Send Pending Candidate Message")
+						conn.pushErrorData(fmt.Errorf("RtcSdpMsg Recv - Failed to send RtcCandidate: %w", err))
+						candidatesMux.Unlock()
+						return
+					}
+				}
+				candidatesMux.Unlock()
+			} else if msg.Candidate != nil {
+				// log.Debug().Msg("Listener: RtcCandidateMsg")
+				err := peerConnection.AddICECandidate(msg.Candidate.CandidateInit)
+				if err != nil {
+					logger.Error().
+						Err(err).
+						Msg("Listener: AddICECandidate")
+					conn.pushErrorData(fmt.Errorf("RtcCandidateMsg Recv - Failed to add candidate: %w", err))
+					return
+				}
+			} else {
+				// Warning: no valid message included
+				trace("Listener: received unknown message: " + string(dat))
+				continue
 			}
-			candidatesMux.Unlock()
-		} else if msg.Candidate != nil {
-			// log.Debug().Msg("Listener: RtcCandidateMsg")
-			err := peerConnection.AddICECandidate(msg.Candidate.CandidateInit)
-			if err != nil {
-				logger.Error().
-					Err(err).
-					Msg("Listener: AddICECandidate")
-				l.pendingAcceptErrors <- fmt.Errorf("RtcCandidateMsg Recv - Failed to add candidate: %w", err)
-				return
-			}
-		} else {
-			// Warning: no valid message included
-			trace("Listener: ws received unknown message: " + string(buf[:n]))
-			continue
 		}
+	}()
+
+	// Wait until the webrtc connection is finished getting setup
+	select {
+	case <-ctx.Done():
+		return nil, fmt.Errorf("%w: %w", errDialerFailed, ctx.Err())
+	case err := <-conn.errorChan:
+		return nil, fmt.Errorf("%w: %w", errDialerFailed, err) // There was an error in setup
+	case <-connFinish:
+		success = true
+		return conn, nil
 	}
 }
-
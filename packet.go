@@ -0,0 +1,240 @@
+package rtcnet
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The label of the data channel that backs the PacketConn API. This channel is unordered and never retransmits, so it behaves like UDP
+const packetChannelLabel = "packet"
+
+// The number of packets that are buffered by the listener packet conn before new packets get dropped
+const packetBufferSize = 1024
+
+var ErrUnknownPeer = errors.New("rtcnet: no peer with that address")
+
+func packetChannelConfig() ChannelConfig {
+	maxRetransmits := uint16(0)
+	return ChannelConfig{
+		Label: packetChannelLabel,
+		Ordered: false,
+		MaxRetransmits: &maxRetransmits,
+	}
+}
+
+// Returns a net.PacketConn that sends packets to the remote peer over an unreliable, unordered data channel. Returns nil if the conn was dialed without DialConfig.PacketChannel or if it uses the websocket fallback.
+// Every packet read comes from the remote address of the conn, and every packet written goes to it.
+func (c *Conn) PacketConn() net.PacketConn {
+	channel := c.Channel(packetChannelLabel)
+	if channel == nil {
+		return nil
+	}
+	return &peerPacketConn{channel}
+}
+
+// Returns the address of the peer in the Listener.PacketConn, or nil if the conn wasn't accepted with a packet channel
+func (c *Conn) PacketAddr() net.Addr {
+	if c.packetAddr == nil {
+		return nil // Note: Avoid returning a typed nil
+	}
+	return *c.packetAddr
+}
+
+// --------------------------------------------------------------------------------
+// - Dialer
+// --------------------------------------------------------------------------------
+// A net.PacketConn that is connected to a single peer
+type peerPacketConn struct {
+	conn *Conn
+}
+
+// Reads the next packet into b. Packets that don't fit are truncated, like in listenerPacketConn.ReadFrom
+func (p *peerPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	dat, err := p.conn.ReadMessage()
+	if err != nil {
+		return 0, nil, err
+	}
+	return copy(b, dat), p.conn.RemoteAddr(), nil
+}
+
+// Writes the packet to the remote peer. The address is ignored, because there is only one peer
+func (p *peerPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return p.conn.Write(b)
+}
+
+func (p *peerPacketConn) Close() error {
+	return p.conn.Close()
+}
+
+func (p *peerPacketConn) LocalAddr() net.Addr {
+	return p.conn.LocalAddr()
+}
+
+func (p *peerPacketConn) SetDeadline(t time.Time) error {
+	return p.conn.SetDeadline(t)
+}
+
+func (p *peerPacketConn) SetReadDeadline(t time.Time) error {
+	return p.conn.SetReadDeadline(t)
+}
+
+func (p *peerPacketConn) SetWriteDeadline(t time.Time) error {
+	return p.conn.SetWriteDeadline(t)
+}
+
+// --------------------------------------------------------------------------------
+// - Listener
+// --------------------------------------------------------------------------------
+type packet struct {
+	data []byte
+	addr net.Addr
+}
+
+// The address of a peer of the listener PacketConn. Every accepted conn gets its own id, because the remote address alone isn't unique, like for peers that were signalled over the same keep-alive HTTP connection through a proxy. See Conn.PacketAddr
+type PeerAddr struct {
+	ID uint64
+	Remote net.Addr // The remote address of the conn
+}
+
+func (a PeerAddr) Network() string {
+	return "rtcnet-peer"
+}
+
+func (a PeerAddr) String() string {
+	return fmt.Sprintf("%d/%s", a.ID, a.Remote)
+}
+
+// A net.PacketConn that multiplexes the packet channels of every accepted peer. Peers are addressed by a PeerAddr
+type listenerPacketConn struct {
+	localAddr net.Addr
+
+	nextId atomic.Uint64
+	peersMux sync.Mutex
+	peers map[uint64]*Conn
+
+	readChan chan packet
+	readDeadline *deadline
+	writeDeadline *deadline
+
+	closeOnce sync.Once
+	closeChan chan struct{}
+}
+
+func newListenerPacketConn(localAddr net.Addr) *listenerPacketConn {
+	return &listenerPacketConn{
+		localAddr: localAddr,
+		peers: make(map[uint64]*Conn),
+		readChan: make(chan packet, packetBufferSize),
+		readDeadline: newDeadline(),
+		writeDeadline: newDeadline(),
+		closeChan: make(chan struct{}),
+	}
+}
+
+// Registers the packet channel of a newly accepted peer and starts reading from it. Returns the address of the peer. The peer is removed once its channel closes
+func (p *listenerPacketConn) addPeer(channel *Conn) PeerAddr {
+	addr := PeerAddr{p.nextId.Add(1), channel.RemoteAddr()}
+
+	p.peersMux.Lock()
+	p.peers[addr.ID] = channel
+	p.peersMux.Unlock()
+
+	go func() {
+		defer func() {
+			p.peersMux.Lock()
+			delete(p.peers, addr.ID)
+			p.peersMux.Unlock()
+		}()
+
+		for {
+			dat, err := channel.ReadMessage()
+			if err != nil {
+				return
+			}
+
+			select {
+			case p.readChan <- packet{dat, addr}:
+			case <-p.closeChan:
+				return
+			default:
+				// Note: Just like UDP, drop the packet if nobody is reading fast enough
+				trace("listenerPacketConn: dropped packet")
+			}
+		}
+	}()
+	return addr
+}
+
+func (p *listenerPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	if isDone(p.closeChan) {
+		return 0, nil, net.ErrClosed
+	}
+	if isDone(p.readDeadline.wait()) {
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+
+	select {
+	case pkt := <-p.readChan:
+		// Note: Matches UDP behavior, where the remainder of the packet is discarded
+		n := copy(b, pkt.data)
+		return n, pkt.addr, nil
+	case <-p.readDeadline.wait():
+		return 0, nil, os.ErrDeadlineExceeded
+	case <-p.closeChan:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (p *listenerPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if isDone(p.closeChan) {
+		return 0, net.ErrClosed
+	}
+	if isDone(p.writeDeadline.wait()) {
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	peerAddr, ok := addr.(PeerAddr)
+	if !ok {
+		return 0, ErrUnknownPeer
+	}
+	p.peersMux.Lock()
+	channel, ok := p.peers[peerAddr.ID]
+	p.peersMux.Unlock()
+	if !ok {
+		return 0, ErrUnknownPeer
+	}
+	return channel.Write(b)
+}
+
+// Stops reading packets. This does not close the peer connections, those are closed through the conns returned by Accept
+func (p *listenerPacketConn) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closeChan)
+	})
+	return nil
+}
+
+func (p *listenerPacketConn) LocalAddr() net.Addr {
+	return p.localAddr
+}
+
+func (p *listenerPacketConn) SetDeadline(t time.Time) error {
+	p.readDeadline.set(t)
+	p.writeDeadline.set(t)
+	return nil
+}
+
+func (p *listenerPacketConn) SetReadDeadline(t time.Time) error {
+	p.readDeadline.set(t)
+	return nil
+}
+
+func (p *listenerPacketConn) SetWriteDeadline(t time.Time) error {
+	p.writeDeadline.set(t)
+	return nil
+}
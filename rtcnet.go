@@ -1,36 +1,166 @@
 package rtcnet
 
 import (
+	"io"
+	"slices"
+	"time"
+
 	"github.com/pion/webrtc/v4"
 )
 
 // Notes: https://webrtcforthecurious.com/docs/01-what-why-and-how/
 // Notes: about reliability: https://stackoverflow.com/questions/54292824/webrtc-channel-reliability
-// TODO - Let stun server list be injectable
 
-// TODO - Interesting note: if you run this in a docker container with the networking set to something other than "host" (ie the default is bridge), then what happens is the docker container gets NAT'ed behind the original host which causes you to need an ICE server. So You must run this code with HOST networking!!!
+// Interesting note: if you run this in a docker container with the networking set to something other than "host" (ie the default is bridge), then what happens is the docker container gets NAT'ed behind the original host which causes you to need an ICE server. So either run this code with HOST networking, or publish a UDP port range and set NetworkConfig.NAT1To1IPs and NetworkConfig.PortMin/PortMax to match
 // - Read more here: https://stackoverflow.com/questions/32301119/is-ice-necessary-for-client-server-webrtc-applications
 // - and here: https://forums.docker.com/t/connect-container-without-nat/54783
-// - TODO - There might be some way to avoid this with: https://pkg.go.dev/github.com/pion/webrtc/v3#SettingEngine.SetNAT1To1IPs
-// - TODO - also this: https://pkg.go.dev/github.com/pion/webrtc/v3#SettingEngine.SetICEUDPMux
+// - Also see ListenConfig.UdpMuxAddress, which makes every peer use a single UDP port, so only that one port needs to be published, and ListenConfig.TcpMuxAddress, which does the same for ICE-TCP
+
+// The largest message that we are willing to receive. Each Conn holds a read buffer of this size
+const maxMessageSize = 64 * 1024
+
+// The ICE timeouts that pion uses by default
+const (
+	defaultIceDisconnectedTimeout = 5 * time.Second
+	defaultIceFailedTimeout = 25 * time.Second
+	defaultIceKeepaliveInterval = 2 * time.Second
+)
+
+// Network settings for the ICE agent of each peer connection. Apart from the ICE servers and the transport policy, these only apply to desktop builds, because browsers manage their own networking
+type NetworkConfig struct {
+	// Public IPs that are advertised in place of the host candidates. Use this when running behind a 1:1 NAT, like a docker container with bridge networking or a cloud VM, so that peers can reach us without an ICE server
+	NAT1To1IPs []string
+
+	// The range of local UDP ports that ICE binds to. Zero means any port
+	PortMin, PortMax uint16
+
+	// The network types that candidates are gathered for, like webrtc.NetworkTypeUDP4 or webrtc.NetworkTypeTCP4. Defaults to the UDP types, plus the TCP types on a listener with a ListenConfig.TcpMuxAddress. Dialers must add TCP to reach the ICE-TCP candidates of such a listener
+	NetworkTypes []webrtc.NetworkType
+
+	// If set, candidates are only gathered on the network interfaces that this returns true for
+	InterfaceFilter func(name string) bool
+
+	// ICE timeouts, see webrtc.SettingEngine.SetICETimeouts. Zero uses the pion default
+	DisconnectedTimeout time.Duration
+	FailedTimeout time.Duration
+	KeepaliveInterval time.Duration
+
+	// ICE servers to use, like TURN servers with their usernames and credentials. These are used along with the plain urls of DialConfig.IceServers or ListenConfig.IceServers, so that several servers with different credentials can be configured
+	IceServers []webrtc.ICEServer
+
+	// Which candidates ICE is allowed to use. Set this to webrtc.ICETransportPolicyRelay to only connect through TURN servers, which hides the IP addresses of the peers. Defaults to every candidate
+	IceTransportPolicy webrtc.ICETransportPolicy
+
+	// If set, this is copied and used as the starting point for the settings of each peer connection, so that any other pion setting can be injected. The settings above that are set, and the settings that rtcnet relies on, like detached data channels and the listener muxes, are applied on top of it. Defaults like the network types are left to it
+	SettingEngine *webrtc.SettingEngine
+
+	udpMux io.Closer // The shared UDP mux of the listener, see ListenConfig.UdpMuxAddress
+	tcpMux io.Closer // The shared TCP mux of the listener, see ListenConfig.TcpMuxAddress
+}
+
+// Returns the webrtc configuration of a peer connection, with the ICE servers and transport policy
+func getRtcConfiguration(iceServerUrls []string, network NetworkConfig) webrtc.Configuration {
+	config := webrtc.Configuration{
+		ICEServers: []webrtc.ICEServer{
+			// {
+			// 	URLs: []string{"stun:stun.l.google.com:19302"},
+			// },
+		},
+		ICETransportPolicy: network.IceTransportPolicy,
+	}
+	if len(iceServerUrls) > 0 {
+		config.ICEServers = append(config.ICEServers,
+			webrtc.ICEServer{
+				URLs: iceServerUrls,
+			})
+	}
+	config.ICEServers = append(config.ICEServers, network.IceServers...)
+	return config
+}
 
 // Current settings engine settings
 // Detaching the datachannel: https://github.com/pion/webrtc/tree/master/examples/data-channels-detach
-func getSettingsEngineApi() *webrtc.API {
+func getSettingsEngineApi(network NetworkConfig) (*webrtc.API, error) {
 	s := webrtc.SettingEngine{}
+	if network.SettingEngine != nil {
+		s = *network.SettingEngine
+	}
 	s.DetachDataChannels()
-	return webrtc.NewAPI(webrtc.WithSettingEngine(s))
+	err := applyPlatformSettings(&s, network)
+	if err != nil {
+		return nil, err
+	}
+	return webrtc.NewAPI(webrtc.WithSettingEngine(s)), nil
 }
 
+// The version of the signalling protocol. This must be bumped whenever the signalling messages change in a way that older peers can't understand. Version 0 is the original unversioned protocol, which never sends a version message
+const ProtocolVersion = 1
+
+// Optional features of the signalling protocol. The listener replies with the features that both peers support
+const (
+	capabilityHello = "hello"
+	capabilityIceServers = "iceServers"
+)
+
+var capabilities = []string{capabilityHello, capabilityIceServers}
+
+// Returns the capabilities that are in both lists
+func intersectCapabilities(a, b []string) []string {
+	ret := make([]string, 0, len(a))
+	for _, c := range a {
+		if slices.Contains(b, c) {
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
+
+// The largest hello payload that can be sent during signalling
+const maxHelloSize = 4 * 1024
+
 // Internal messages used for webrtc negotiation/signalling
 type signalMsg struct {
 	SDP *sdpMsg
 	Candidate *candidateMsg
+	Hello *helloMsg `json:",omitempty"`
+	HelloReply *helloReplyMsg `json:",omitempty"`
+	Version *versionMsg `json:",omitempty"`
+	VersionReply *versionReplyMsg `json:",omitempty"`
+}
+
+// Sent by the dialer before any other message
+type versionMsg struct {
+	Version int
+	Capabilities []string
+}
+
+// Sent by the listener in response to a version, or to the first message of a dialer that predates versioning
+type versionReplyMsg struct {
+	Accept bool
+	Version int // The version that will be used, which is the older of the two peers
+	MinVersion int // The oldest version that the listener accepts
+	Capabilities []string
+}
+
+// Sent by the dialer before the SDP offer
+type helloMsg struct {
+	Payload []byte
+}
+
+// Sent by the listener in response to a hello
+type helloReplyMsg struct {
+	Accept bool
+	Payload []byte
+	IceServers []iceServerMsg `json:",omitempty"` // ICE servers for the dialer to use, like TURN servers with minted credentials, see ListenConfig.TurnRest
 }
 
 type sdpMsg struct {
 	Type webrtc.SDPType
 	SDP string
+	Channels []string `json:",omitempty"` // The labels of the additional data channels that the dialer is opening
+	Fragment bool `json:",omitempty"` // In an offer, requests fragmentation on the primary data channel. In an answer, confirms it
+	NoTrickle bool `json:",omitempty"` // The SDP already contains every candidate, and no candidates will be trickled. In an offer, also requests the same from the answer
+	Unreliable bool `json:",omitempty"` // In an offer, the primary data channel can drop or reorder messages
 }
 
 type candidateMsg struct {
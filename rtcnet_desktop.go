@@ -0,0 +1,97 @@
+//go:build !js
+// +build !js
+
+package rtcnet
+
+import (
+	"cmp"
+	"io"
+	"net"
+
+	"github.com/pion/ice/v4"
+	"github.com/pion/webrtc/v4"
+)
+
+// The network types of a listener with a TcpMuxAddress, so that it gathers its ICE-TCP candidates along with the UDP ones that pion gathers by default
+var tcpMuxNetworkTypes = []webrtc.NetworkType{
+	webrtc.NetworkTypeUDP4,
+	webrtc.NetworkTypeUDP6,
+	webrtc.NetworkTypeTCP4,
+	webrtc.NetworkTypeTCP6,
+}
+
+// Applies the settings engine settings that are only available when running natively
+func applyPlatformSettings(s *webrtc.SettingEngine, network NetworkConfig) error {
+	if mux, ok := network.udpMux.(ice.UDPMux); ok {
+		s.SetICEUDPMux(mux)
+	}
+	if mux, ok := network.tcpMux.(ice.TCPMux); ok {
+		s.SetICETCPMux(mux)
+	}
+	if len(network.NAT1To1IPs) > 0 {
+		s.SetNAT1To1IPs(network.NAT1To1IPs, webrtc.ICECandidateTypeHost)
+	}
+	if network.PortMin != 0 || network.PortMax != 0 {
+		err := s.SetEphemeralUDPPortRange(network.PortMin, network.PortMax)
+		if err != nil {
+			return err
+		}
+	}
+	// Note: An injected SettingEngine keeps its own network types
+	if len(network.NetworkTypes) > 0 {
+		s.SetNetworkTypes(network.NetworkTypes)
+	} else if network.SettingEngine == nil && network.tcpMux != nil {
+		s.SetNetworkTypes(tcpMuxNetworkTypes)
+	}
+	if network.InterfaceFilter != nil {
+		s.SetInterfaceFilter(network.InterfaceFilter)
+	}
+
+	// Note: Pion sets all of the timeouts together, so fill in the defaults for the ones that weren't set
+	if network.DisconnectedTimeout != 0 || network.FailedTimeout != 0 || network.KeepaliveInterval != 0 {
+		s.SetICETimeouts(
+			cmp.Or(network.DisconnectedTimeout, defaultIceDisconnectedTimeout),
+			cmp.Or(network.FailedTimeout, defaultIceFailedTimeout),
+			cmp.Or(network.KeepaliveInterval, defaultIceKeepaliveInterval),
+		)
+	}
+	return nil
+}
+
+// Returns the largest message that can be sent to the remote peer, or 0 if it isn't known yet
+func remoteMaxMessageSize(peer *webrtc.PeerConnection) int {
+	return int(peer.SCTP().GetCapabilities().MaxMessageSize)
+}
+
+// Listens on the UDP address and returns a mux that carries the ICE traffic of many peer connections over that one socket
+func newUdpMux(address string) (io.Closer, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	// Note: An address without an IP, like ":3478", listens on the port of every interface
+	if udpAddr.IP == nil || udpAddr.IP.IsUnspecified() {
+		return ice.NewMultiUDPMuxFromPort(udpAddr.Port)
+	}
+
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	return ice.NewUDPMuxDefault(ice.UDPMuxParams{
+		UDPConn: conn,
+	}), nil
+}
+
+// Listens on the TCP address and returns a mux that carries the ICE-TCP traffic of many peer connections over that one port
+func newTcpMux(address string) (io.Closer, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return ice.NewTCPMuxDefault(ice.TCPMuxParams{
+		Listener: listener,
+		ReadBufferSize: 8, // Note: The number of packets that are buffered for each conn, like the pion ice-tcp example
+	}), nil
+}
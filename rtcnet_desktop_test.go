@@ -0,0 +1,75 @@
+//go:build !js
+// +build !js
+
+package rtcnet
+
+import (
+	"context"
+	"crypto/tls"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Note: The settings engine of pion only has detached data channels in the browser, so this can only run natively
+func TestSettingEngine(t *testing.T) {
+	listenSettings := &webrtc.SettingEngine{}
+	listenSettings.SetICECredentials("listenufrag", "listenpasswordlistenpassword")
+	listenSettings.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4, webrtc.NetworkTypeTCP4})
+	_, accepted := listenAccept(t, "localhost:2032", ListenConfig{
+		OriginPatterns: []string{"localhost", "localhost:2032"},
+		UdpMuxAddress: ":2032",
+		TcpMuxAddress: ":2035",
+		Network: NetworkConfig{
+			SettingEngine: listenSettings,
+		},
+	})
+
+	dial := func(settings *webrtc.SettingEngine) (*Conn, *Conn) {
+		conn, err := DialContext(context.Background(), "localhost:2032", DialConfig{
+			TlsConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+			Ordered: true,
+			Timeout: 10 * time.Second,
+			Network: NetworkConfig{
+				SettingEngine: settings,
+			},
+		})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		return conn, nextAccepted(t, accepted)
+	}
+
+	dialSettings := &webrtc.SettingEngine{}
+	dialSettings.SetICECredentials("dialufrag", "dialpassworddialpassword")
+	conn, lConn := dial(dialSettings)
+
+	// The injected settings take effect on both sides
+	check(t, strings.Contains(lConn.peerConn.LocalDescription().SDP, "a=ice-ufrag:listenufrag"))
+	check(t, strings.Contains(conn.peerConn.LocalDescription().SDP, "a=ice-ufrag:dialufrag"))
+
+	// The settings of rtcnet still apply on top of them. The detached data channels carry the messages, and the listener uses its UDP mux
+	check(t, conn.WriteMessage([]byte("hello")) == nil)
+	msg, err := lConn.ReadMessage()
+	check(t, err == nil)
+	compare(t, string(msg), "hello")
+	pair := selectedPair(t, lConn)
+	compare(t, pair.Local.Protocol, webrtc.ICEProtocolUDP)
+	compare(t, pair.Local.Port, uint16(2032))
+	conn.Close()
+	lConn.Close()
+
+	// Injected network types aren't replaced by the defaults of rtcnet
+	tcpSettings := &webrtc.SettingEngine{}
+	tcpSettings.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeTCP4})
+	conn, lConn = dial(tcpSettings)
+	pair = selectedPair(t, lConn)
+	compare(t, pair.Local.Protocol, webrtc.ICEProtocolTCP)
+	compare(t, pair.Local.Port, uint16(2035))
+	conn.Close()
+	lConn.Close()
+}
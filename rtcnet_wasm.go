@@ -0,0 +1,40 @@
+//go:build js
+// +build js
+
+package rtcnet
+
+import (
+	"errors"
+	"io"
+	"math"
+	"syscall/js"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Note: In the browser, the settings engine has very few settings. The browser decides things like the max message size, and it manages its own networking, so the network config is ignored
+func applyPlatformSettings(s *webrtc.SettingEngine, network NetworkConfig) error {
+	return nil
+}
+
+// Returns the largest message that can be sent to the remote peer, or 0 if it isn't known yet
+func remoteMaxMessageSize(peer *webrtc.PeerConnection) int {
+	sctp := peer.SCTP()
+	if sctp == nil {
+		return 0
+	}
+	size := sctp.JSValue().Get("maxMessageSize")
+	if size.Type() != js.TypeNumber {
+		return 0
+	}
+	return int(min(size.Float(), math.MaxInt32)) // Note: The browser reports Infinity if there is no limit
+}
+
+// Note: Browsers can't listen, so there is nothing to mux
+func newUdpMux(address string) (io.Closer, error) {
+	return nil, errors.New("rtcnet: udp mux is not supported in the browser")
+}
+
+func newTcpMux(address string) (io.Closer, error) {
+	return nil, errors.New("rtcnet: tcp mux is not supported in the browser")
+}
@@ -0,0 +1,96 @@
+package rtcnet
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+)
+
+// Carries the signalling messages that negotiate a webrtc connection, like the SDP offer and answer and the ICE candidates. Messages are opaque blobs that must be delivered intact and in order. Dial and Listener signal over a websocket, but webrtc can be negotiated over anything that can carry messages, like an existing TCP connection, an HTTP long-poll or a message bus. See DialOver and AcceptOver
+// If the signaler also has LocalAddr and RemoteAddr methods, like a net.Conn, then the negotiated conn reports those addresses
+type Signaler interface {
+	// Sends one message to the peer
+	Send(ctx context.Context, msg []byte) error
+
+	// Blocks until the next message from the peer arrives. This must return once the context is cancelled, without consuming a message
+	Receive(ctx context.Context) ([]byte, error)
+}
+
+// Returned when the signaler stops working before the connection finishes getting setup
+var errSignalClosed = errors.New("rtcnet: signalling closed before the connection was established")
+
+// Negotiates a webrtc connection over the signaler, with a peer that is calling AcceptOver on the other end. Only the webrtc related fields of the config are used, the address and websocket fields are ignored. The signaler is not closed, and it stops being read from once this returns
+func DialOver(ctx context.Context, signaler Signaler, config DialConfig) (*Conn, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	dialCtx, cancel := withDialTimeout(ctx, config.Timeout)
+	defer cancel()
+
+	return dialOver(dialCtx, signaler, config)
+}
+
+// Returned by AcceptOver if the config has a UdpMuxAddress or TcpMuxAddress, because the muxes are owned by a Listener
+var errAcceptOverMux = errors.New("rtcnet: AcceptOver doesn't support UdpMuxAddress or TcpMuxAddress")
+
+// Accepts a webrtc connection over the signaler, from a peer that is calling DialOver on the other end. Only the webrtc related fields of the config are used, and Authenticate is not called because the signaler is assumed to be authenticated already. The signaler is not closed, and it stops being read from once this returns
+func AcceptOver(ctx context.Context, signaler Signaler, config ListenConfig) (*Conn, error) {
+	if config.UdpMuxAddress != "" || config.TcpMuxAddress != "" {
+		return nil, errAcceptOverMux
+	}
+
+	metadata := &Metadata{}
+	if _, remoteAddr := signalerAddrs(signaler); remoteAddr != (signalerAddr{}) {
+		metadata.RemoteAddr = remoteAddr.String()
+	}
+	return acceptWebRtc(ctx, signaler, config, metadata)
+}
+
+// The address of a conn that was negotiated over a signaler without a network address
+type signalerAddr struct{}
+
+func (a signalerAddr) Network() string {
+	return "signaler"
+}
+
+func (a signalerAddr) String() string {
+	return "signaler/unknown-addr"
+}
+
+// Returns the addresses of the signaler, if it has any
+func signalerAddrs(signaler Signaler) (net.Addr, net.Addr) {
+	addrs, ok := signaler.(interface {
+		LocalAddr() net.Addr
+		RemoteAddr() net.Addr
+	})
+	if !ok {
+		return signalerAddr{}, signalerAddr{}
+	}
+	return addrs.LocalAddr(), addrs.RemoteAddr()
+}
+
+func sendMsg(ctx context.Context, signaler Signaler, msg signalMsg) error {
+	// log.Print("sendMsg: ", msg)
+	msgDat, err := json.Marshal(msg)
+	if err != nil {
+		logger.Error().
+			Err(err).
+			Msg("sendMsg: Marshal")
+		return err
+	}
+
+	// log.Print("sendMsg: Marshalled: ", string(msgDat))
+
+	err = signaler.Send(ctx, msgDat)
+	if err != nil {
+		logger.Error().
+			Err(err).
+			Msg("sendMsg: signaler send")
+		return err
+	}
+
+	return nil
+}
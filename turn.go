@@ -0,0 +1,77 @@
+package rtcnet
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"strconv"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// The default lifetime of minted TURN credentials, which must outlive the TURN allocation of the conn
+const defaultTurnRestTTL = 24 * time.Hour
+
+// TURN servers that use the TURN REST API shared secret scheme, like coturn with use-auth-secret, so that clients never need to ship a TURN secret
+type TurnRestConfig struct {
+	// The TURN urls, like "turn:turn.example.com:3478?transport=udp" or "turns:turn.example.com:5349"
+	URLs []string
+
+	// The secret that is shared with the TURN server, like the static-auth-secret of coturn
+	Secret string
+
+	// How long the minted credentials are valid for. Defaults to 24 hours
+	TTL time.Duration
+
+	// If set, this returns the user id that is added to the minted username, like the identity of the dialer. It is called once the hello is accepted
+	User func(metadata *Metadata) string
+}
+
+// Mints credentials for the dialer and returns the ICE servers that use them
+func (c *TurnRestConfig) iceServers(metadata *Metadata, now time.Time) []iceServerMsg {
+	ttl := c.TTL
+	if ttl <= 0 {
+		ttl = defaultTurnRestTTL
+	}
+	user := ""
+	if c.User != nil {
+		user = c.User(metadata)
+	}
+
+	username, credential := turnRestCredentials(c.Secret, user, now.Add(ttl))
+	return []iceServerMsg{
+		{c.URLs, username, credential},
+	}
+}
+
+// Returns the username "expiry:user" and its base64 HMAC-SHA1 credential, as the TURN REST API defines them
+func turnRestCredentials(secret, user string, expires time.Time) (string, string) {
+	username := strconv.FormatInt(expires.Unix(), 10)
+	if user != "" {
+		username += ":" + user
+	}
+
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return username, base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// An ICE server that the listener hands to the dialer during signalling
+type iceServerMsg struct {
+	URLs []string
+	Username string `json:",omitempty"`
+	Credential string `json:",omitempty"`
+}
+
+func toIceServers(msgs []iceServerMsg) []webrtc.ICEServer {
+	servers := make([]webrtc.ICEServer, 0, len(msgs))
+	for _, m := range msgs {
+		servers = append(servers, webrtc.ICEServer{
+			URLs: m.URLs,
+			Username: m.Username,
+			Credential: m.Credential,
+		})
+	}
+	return servers
+}
@@ -0,0 +1,171 @@
+package rtcnet
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// The largest signalling message that can be sent over an upgraded conn
+const maxStreamSignalSize = 64 * 1024
+
+// Negotiates a webrtc connection with the peer on the other end of an existing conn, like an authenticated TCP or websocket control connection. The peer must call AcceptUpgrade on its end of the conn. If keep is true, then the conn is left open once the upgrade finishes, so that it can keep being used as a side channel. Otherwise it is closed. If the upgrade fails, then the conn is always closed
+func DialUpgrade(ctx context.Context, conn net.Conn, keep bool, config DialConfig) (*Conn, error) {
+	signaler := newStreamSignaler(conn)
+	rtcConn, err := DialOver(ctx, signaler, config)
+	return finishUpgrade(ctx, signaler, rtcConn, err, keep)
+}
+
+// Accepts a webrtc connection from the peer on the other end of an existing conn, which is calling DialUpgrade on its end. See DialUpgrade and AcceptOver
+func AcceptUpgrade(ctx context.Context, conn net.Conn, keep bool, config ListenConfig) (*Conn, error) {
+	signaler := newStreamSignaler(conn)
+	rtcConn, err := AcceptOver(ctx, signaler, config)
+	return finishUpgrade(ctx, signaler, rtcConn, err, keep)
+}
+
+// Hands the conn back once both peers have finished signalling, so that nothing is left unread on it
+func finishUpgrade(ctx context.Context, signaler *streamSignaler, conn *Conn, err error, keep bool) (*Conn, error) {
+	if err == nil {
+		err = signaler.finish(ctx)
+		if err != nil {
+			conn.Close()
+		}
+	}
+	if err != nil || !keep {
+		signaler.conn.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Carries signalling messages over a byte stream, like a TCP conn, by prefixing each message with its length. An empty message marks the end of the signalling, see finish
+type streamSignaler struct {
+	conn net.Conn
+	msgs chan []byte
+	stopping chan struct{} // Closed once we stop receiving
+	peerDone chan struct{} // Closed once the read goroutine exits, either because the peer finished or because of readErr
+	readErr error
+
+	sendMux sync.Mutex
+	sendDone bool
+}
+
+func newStreamSignaler(conn net.Conn) *streamSignaler {
+	s := &streamSignaler{
+		conn: conn,
+		msgs: make(chan []byte, 64), // Note: Buffered so that the read goroutine doesn't stall a peer that is sending while we are also sending
+		stopping: make(chan struct{}),
+		peerDone: make(chan struct{}),
+	}
+	go s.readLoop()
+	return s
+}
+
+func (s *streamSignaler) readLoop() {
+	defer close(s.peerDone)
+
+	header := make([]byte, 4)
+	for {
+		_, err := io.ReadFull(s.conn, header)
+		if err != nil {
+			s.readErr = err
+			return
+		}
+		size := binary.BigEndian.Uint32(header)
+		if size == 0 {
+			return // The peer finished signalling
+		}
+		if size > maxStreamSignalSize {
+			s.readErr = fmt.Errorf("rtcnet: signalling message is larger than %d bytes", maxStreamSignalSize)
+			return
+		}
+
+		dat := make([]byte, size)
+		_, err = io.ReadFull(s.conn, dat)
+		if err != nil {
+			s.readErr = err
+			return
+		}
+
+		select {
+		case s.msgs <- dat:
+		case <-s.stopping:
+			// Nobody is receiving anymore, so drop leftover messages, like late candidates
+		}
+	}
+}
+
+func (s *streamSignaler) Send(ctx context.Context, msg []byte) error {
+	if len(msg) > maxStreamSignalSize {
+		return fmt.Errorf("rtcnet: signalling message is larger than %d bytes", maxStreamSignalSize)
+	}
+
+	s.sendMux.Lock()
+	defer s.sendMux.Unlock()
+	if s.sendDone {
+		return net.ErrClosed
+	}
+	return s.writeFrame(msg)
+}
+
+func (s *streamSignaler) Receive(ctx context.Context) ([]byte, error) {
+	select {
+	case dat := <-s.msgs:
+		return dat, nil
+	case <-s.peerDone:
+		// Note: Messages that were buffered before the peer finished still get delivered
+		select {
+		case dat := <-s.msgs:
+			return dat, nil
+		default:
+		}
+		if s.readErr != nil {
+			return nil, s.readErr
+		}
+		return nil, io.EOF
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (s *streamSignaler) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *streamSignaler) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+// Tells the peer that we won't send anything else, and then waits for the peer to say the same. Once this returns there are no pending reads or writes on the conn, so it can be used for something else
+func (s *streamSignaler) finish(ctx context.Context) error {
+	close(s.stopping)
+
+	s.sendMux.Lock()
+	s.sendDone = true
+	err := s.writeFrame(nil)
+	s.sendMux.Unlock()
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-s.peerDone:
+		return s.readErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Note: The header and message are written together, so that a frame is never split by another writer
+func (s *streamSignaler) writeFrame(msg []byte) error {
+	frame := make([]byte, 4 + len(msg))
+	binary.BigEndian.PutUint32(frame, uint32(len(msg)))
+	copy(frame[4:], msg)
+	_, err := s.conn.Write(frame)
+	return err
+}
@@ -4,62 +4,421 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/coder/websocket"
 )
 
-// Returns a connected socket or fails with an error
-func dialWebsocket(address string, tlsConfig *tls.Config, ctx context.Context) (net.Conn, error) {
-	// ctx, _ := context.WithTimeout(context.Background(), 10 * time.Second)
+// Dials the signalling websocket of the address. The websocket lifetime is bound to the context
+func dialWebsocket(address string, config DialConfig, ctx context.Context) (*wsSignaler, error) {
+	wsUrl, err := websocketUrl(address, "", config.Plaintext)
+	if err != nil {
+		return nil, err
+	}
+	wsConn, err := dialWs(ctx, wsUrl, config.TlsConfig, config.Header, config.Subprotocols)
+	if err != nil {
+		return nil, err
+	}
+
+	// Note: Websocket dials don't expose the real network addresses
+	return newWsSignaler(ctx, wsConn, wsAddr("websocket/unknown-addr"), wsAddr(wsUrl)), nil
+}
+
+// Returns the websocket url for the address, with the path suffix appended to the url path. The address is either a full url, like "wss://example.com/realm?ticket=abc", or a host with an optional path, like "example.com:443/realm". If the address has no scheme, then TLS is used unless plaintext is explicitly requested
+func websocketUrl(address string, pathSuffix string, plaintext bool) (string, error) {
+	if !strings.Contains(address, "://") {
+		if plaintext {
+			address = "ws://" + address
+		} else {
+			address = "wss://" + address
+		}
+	}
 
-	url := "wss://" + address
-	wsConn, err := dialWs(ctx, url, tlsConfig)
+	u, err := url.Parse(address)
+	if err != nil {
+		return "", err
+	}
+
+	switch u.Scheme {
+	case "ws", "wss":
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	default:
+		return "", fmt.Errorf("rtcnet: unsupported url scheme: %s", u.Scheme)
+	}
+
+	if pathSuffix != "" {
+		u.Path = strings.TrimSuffix(u.Path, "/") + pathSuffix
+		u.RawPath = ""
+	}
+	return u.String(), nil
+}
+
+// Dials the websocket fallback path and returns a connection that sends its messages directly over the websocket. The context is only used for dialing, it does not bound the lifetime of the returned connection
+func dialWebsocketFallback(ctx context.Context, address string, config DialConfig) (*Conn, error) {
+	wsUrl, err := websocketUrl(address, "/wss", config.Plaintext)
+	if err != nil {
+		return nil, err
+	}
+	subprotocols := append([]string{fragmentSubprotocol}, config.Subprotocols...)
+	if config.Hello != nil {
+		subprotocols = append([]string{helloSubprotocol}, subprotocols...)
+	}
+	wsConn, err := dialWs(ctx, wsUrl, config.TlsConfig, config.Header, subprotocols)
 	if err != nil {
 		return nil, err
 	}
 
-	// Note: The entire websocket net.Conn lifetime is managed by the context too
-	// ctx, cancel := context.WithCancel(context.Background())
-	conn := websocket.NetConn(ctx, wsConn, websocket.MessageBinary)
+	fragment, hello := fallbackFeatures(wsConn.Subprotocol(), subprotocols)
+	conn := newConn(nil, wsAddr("websocket/unknown-addr"), wsAddr(wsUrl))
+	conn.stream = config.Stream
+	conn.subprotocol = appSubprotocol(wsConn.Subprotocol())
+	conn.fragment.Store(fragment)
+	conn.setRaw(newWsTransport(wsConn))
+	conn.transport = TransportWebsocket
 
+	if config.Hello != nil {
+		if !hello {
+			conn.Close()
+			return nil, errHelloUnsupported
+		}
+		reply, err := fallbackHello(ctx, conn, config.Hello)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn.helloReply = reply
+	}
 	return conn, nil
 }
 
+// The websocket subprotocol that is used by fallback dialers that send a hello. The hello is the first message of the dialer, and the listener replies with the hello reply as its first message, or closes the websocket with the reply as the close reason if it rejects the dialer. Dialers that negotiate it also support fragmentation
+const helloSubprotocol = "rtcnet-hello"
+
+// The websocket close status that the listener uses when it rejects a dialer
+const statusRejected = websocket.StatusPolicyViolation
+
+// Returns whether the fallback websocket fragments its messages, and whether the dialer sends a hello. Listeners prefer the subprotocols of the application over ours, and only listeners that support every feature can select them, so then the features are the ones that the dialer offered
+func fallbackFeatures(selected string, offered []string) (fragment, hello bool) {
+	switch selected {
+	case helloSubprotocol:
+		return true, true
+	case fragmentSubprotocol:
+		return true, false
+	case "":
+		return false, false
+	}
+	hello = slices.Contains(offered, helloSubprotocol)
+	return hello || slices.Contains(offered, fragmentSubprotocol), hello
+}
+
+// Returns the subprotocol if it belongs to the application, or "" if it is one of ours
+func appSubprotocol(subprotocol string) string {
+	if subprotocol == fragmentSubprotocol || subprotocol == helloSubprotocol {
+		return ""
+	}
+	return subprotocol
+}
+
+// Returns the subprotocols that the dialer offered in its upgrade request
+func offeredSubprotocols(r *http.Request) []string {
+	var offered []string
+	for _, header := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, subprotocol := range strings.Split(header, ",") {
+			offered = append(offered, strings.TrimSpace(subprotocol))
+		}
+	}
+	return offered
+}
+
+// Sends the hello over the fallback websocket and waits for the reply of the listener. Returns a HelloRejectedError if the listener rejected the dialer
+func fallbackHello(ctx context.Context, conn *Conn, hello []byte) ([]byte, error) {
+	_, err := conn.writeMessage(hello, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// Note: Closing the conn is the only way to interrupt the read if the dial is cancelled
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	reply, err := conn.ReadMessage()
+	if !stop() {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		var closeErr websocket.CloseError
+		if errors.As(err, &closeErr) && closeErr.Code == statusRejected {
+			return nil, &HelloRejectedError{[]byte(closeErr.Reason)}
+		}
+		return nil, err
+	}
+	return reply, nil
+}
+
+// The address of a websocket connection, for when the real network address is unknown
+type wsAddr string
+
+func (a wsAddr) Network() string {
+	return "websocket"
+}
+
+func (a wsAddr) String() string {
+	return string(a)
+}
+
+// Returns the local and remote addresses of the connection that the request was received on
+func requestAddrs(r *http.Request) (net.Addr, net.Addr) {
+	var localAddr net.Addr = wsAddr("websocket/unknown-addr")
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		localAddr = addr
+	}
+
+	var remoteAddr net.Addr = wsAddr(r.RemoteAddr)
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		remoteAddr = addr
+	}
+	return localAddr, remoteAddr
+}
+
+// --------------------------------------------------------------------------------
+// - Signaler
+// --------------------------------------------------------------------------------
+// Carries signalling messages over a websocket, one message per websocket message
+type wsSignaler struct {
+	conn *websocket.Conn
+	ctx context.Context // Bounds the lifetime of the websocket
+	cancel context.CancelFunc
+	localAddr, remoteAddr net.Addr
+}
+
+func newWsSignaler(ctx context.Context, wsConn *websocket.Conn, localAddr, remoteAddr net.Addr) *wsSignaler {
+	ctx, cancel := context.WithCancel(ctx)
+	return &wsSignaler{
+		conn: wsConn,
+		ctx: ctx,
+		cancel: cancel,
+		localAddr: localAddr,
+		remoteAddr: remoteAddr,
+	}
+}
+
+func (s *wsSignaler) Send(ctx context.Context, msg []byte) error {
+	ctx, cancel := mergeContext(ctx, s.ctx)
+	defer cancel()
+	return s.conn.Write(ctx, websocket.MessageBinary, msg)
+}
+
+// Note: If the context is cancelled, then the websocket gets closed. That is fine, because the signalling websocket is closed as soon as the negotiation finishes
+func (s *wsSignaler) Receive(ctx context.Context) ([]byte, error) {
+	ctx, cancel := mergeContext(ctx, s.ctx)
+	defer cancel()
+	_, dat, err := s.conn.Read(ctx)
+	return dat, err
+}
+
+func (s *wsSignaler) LocalAddr() net.Addr {
+	return s.localAddr
+}
+
+func (s *wsSignaler) RemoteAddr() net.Addr {
+	return s.remoteAddr
+}
+
+func (s *wsSignaler) Close() error {
+	defer s.cancel()
+	return s.conn.Close(websocket.StatusNormalClosure, "")
+}
+
+// Closes the websocket because the dialer was rejected, with the reason as the close reason
+func (s *wsSignaler) reject(reason string) error {
+	defer s.cancel()
+	return closeRejected(s.conn, reason)
+}
+
+// Returns a context that is cancelled when either context is
+func mergeContext(a, b context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(a)
+	stop := context.AfterFunc(b, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// --------------------------------------------------------------------------------
+// - Transport
+// --------------------------------------------------------------------------------
+// Adapts a websocket to the datachannel.ReadWriteCloser interface so that a Conn can use it as its raw transport. Every websocket message maps to one data channel message
+type wsTransport struct {
+	conn *websocket.Conn
+	ctx context.Context // Bounds the lifetime of the websocket
+	cancel context.CancelFunc
+
+	writeDeadlineMu sync.Mutex
+	writeDeadline time.Time
+
+	sendsHello bool // On the listening side, the dialer sends its hello as the first message, see helloSubprotocol
+}
+
+func newWsTransport(wsConn *websocket.Conn) *wsTransport {
+	wsConn.SetReadLimit(maxMessageSize) // Note: Larger messages would be dropped anyway, because the read buffer of the conn is this size and writes are fragmented down to it. This stops a peer from making us buffer a message of any size
+	ctx, cancel := context.WithCancel(context.Background())
+	return &wsTransport{
+		conn: wsConn,
+		ctx: ctx,
+		cancel: cancel,
+	}
+}
+
+func (t *wsTransport) Read(b []byte) (int, error) {
+	n, _, err := t.ReadDataChannel(b)
+	return n, err
+}
+
+func (t *wsTransport) ReadDataChannel(b []byte) (int, bool, error) {
+	typ, dat, err := t.conn.Read(t.ctx)
+	if err != nil {
+		switch websocket.CloseStatus(err) {
+		case websocket.StatusNormalClosure, websocket.StatusGoingAway:
+			return 0, false, io.EOF
+		}
+		return 0, false, err
+	}
+
+	// Note: Matches data channel behavior, where the message is dropped if the buffer is too small
+	if len(dat) > len(b) {
+		return 0, false, io.ErrShortBuffer
+	}
+	n := copy(b, dat)
+	return n, typ == websocket.MessageText, nil
+}
+
+func (t *wsTransport) Write(b []byte) (int, error) {
+	return t.WriteDataChannel(b, false)
+}
+
+func (t *wsTransport) WriteDataChannel(b []byte, isString bool) (int, error) {
+	typ := websocket.MessageBinary
+	if isString {
+		typ = websocket.MessageText
+	}
+
+	ctx := t.ctx
+	t.writeDeadlineMu.Lock()
+	writeDeadline := t.writeDeadline
+	t.writeDeadlineMu.Unlock()
+	if !writeDeadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(t.ctx, writeDeadline)
+		defer cancel()
+	}
+
+	// Note: If the deadline is hit in the middle of a write, then the websocket gets closed. This matches websocket.NetConn
+	err := t.conn.Write(ctx, typ, b)
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (t *wsTransport) SetWriteDeadline(deadline time.Time) error {
+	t.writeDeadlineMu.Lock()
+	defer t.writeDeadlineMu.Unlock()
+	t.writeDeadline = deadline
+	return nil
+}
+
+func (t *wsTransport) Close() error {
+	defer t.cancel()
+	return t.conn.Close(websocket.StatusNormalClosure, "")
+}
+
+// Closes the websocket because the dialer was rejected, with the hello reply as the close reason
+func (t *wsTransport) reject(reply []byte) error {
+	defer t.cancel()
+	return closeRejected(t.conn, string(reply))
+}
+
+// The longest close reason that fits in a websocket close frame
+const maxCloseReason = 123
+
+// Closes the websocket with statusRejected, and the reason cut down to the longest close reason that a websocket allows
+func closeRejected(conn *websocket.Conn, reason string) error {
+	reason = strings.ToValidUTF8(reason, "")
+	for len(reason) > maxCloseReason {
+		_, size := utf8.DecodeLastRuneInString(reason)
+		reason = reason[:len(reason) - size]
+	}
+	return conn.Close(statusRejected, reason)
+}
+
 // --------------------------------------------------------------------------------
 // - Listener
 // --------------------------------------------------------------------------------
 type websocketListener struct {
-	httpServer *http.Server
+	httpServer *http.Server // Nil if the listener is mounted as a handler on some other server
 	originPatterns []string
+	subprotocols []string
+	authenticate func(r *http.Request) (any, error)
 	addr net.Addr
 	// encoder Serdes
 	// decoder Serdes
 	closed atomic.Bool
-	pendingAccepts chan net.Conn // TODO - should this get buffered?
+	closeOnce sync.Once
+	closeChan chan struct{}
+	pendingAccepts chan io.Closer // Either a *Conn for the websocket fallback, or a *signalConn. TODO - should this get buffered?
 	pendingAcceptErrors chan error // TODO - should this get buffered?
 }
 
+// Returns a websocket listener that doesn't own a network listener. Connections are only accepted through ServeHTTP
+func newWebsocketHandler(addr net.Addr, config ListenConfig) *websocketListener {
+	return &websocketListener{
+		addr: addr,
+		pendingAccepts: make(chan io.Closer),
+		pendingAcceptErrors: make(chan error),
+		closeChan: make(chan struct{}),
+		originPatterns: config.OriginPatterns,
+		subprotocols: config.Subprotocols,
+		authenticate: config.Authenticate,
+	}
+}
+
 func newWebsocketListener(address string, config ListenConfig) (*websocketListener, error) {
 	// TODO - Is tcp always correct here?
-	listener, err := tls.Listen("tcp", address, config.TlsConfig)
+	var listener net.Listener
+	var err error
+	if config.Plaintext {
+		logger.Warn().Str("Address", address).Msg("Listening without TLS")
+		listener, err = net.Listen("tcp", address)
+	} else {
+		listener, err = tls.Listen("tcp", address, config.TlsConfig)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	wsl := &websocketListener{
-		addr: listener.Addr(),
-		pendingAccepts: make(chan net.Conn),
-		pendingAcceptErrors: make(chan error),
-		originPatterns: config.OriginPatterns,
-		httpServer: &http.Server{
-			TLSConfig: config.TlsConfig,
-			ReadTimeout: 10 * time.Second,
-			WriteTimeout: 10 * time.Second,
-		},
+	wsl := newWebsocketHandler(listener.Addr(), config)
+	wsl.httpServer = &http.Server{
+		ReadTimeout: 10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+	if !config.Plaintext {
+		wsl.httpServer.TLSConfig = config.TlsConfig
 	}
 
 	// httpServer := c.HttpServer
@@ -76,7 +435,7 @@ func newWebsocketListener(address string, config ListenConfig) (*websocketListen
 			}
 
 			// TODO - Passing serve errors back through the accept channel. This might be a slightly leaky abstraction. Because these are server errors not really accept errors.
-			wsl.pendingAcceptErrors <- err
+			wsl.pushAcceptError(err)
 
 			time.Sleep(1 * time.Second)
 		}
@@ -85,58 +444,138 @@ func newWebsocketListener(address string, config ListenConfig) (*websocketListen
 	return wsl, nil
 }
 
-type wsFallback struct {
-	net.Conn
+// A signaler that was accepted for webrtc signalling, either a websocket or an HTTP request
+type signalConn struct {
+	Signaler
+	io.Closer
+	metadata *Metadata
+	subprotocol string // The subprotocol of the signalling websocket
 }
 
 func (l *websocketListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	wsConn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
-		OriginPatterns: l.originPatterns,
-	})
-	if err != nil {
-		// Return as an accept error
-		l.pendingAcceptErrors <- err
+	// Note: Browsers don't send credentials with a CORS preflight, so it must be answered before authenticating
+	if r.Method == http.MethodOptions {
+		l.serveHttpPreflight(w, r)
+		return
+	}
+
+	// Note: Authenticate before upgrading, so that rejected requests never allocate any websocket or webrtc resources
+	var identity any
+	if l.authenticate != nil {
+		var err error
+		identity, err = l.authenticate(r)
+		if err != nil {
+			status := http.StatusForbidden
+			reason := http.StatusText(status)
+			var rejectErr *RejectError
+			if errors.As(err, &rejectErr) {
+				status = rejectErr.Status
+				reason = rejectErr.Reason
+			}
+			logger.Debug().
+				Err(err).
+				Str("RemoteAddr", r.RemoteAddr).
+				Int("Status", status).
+				Msg("Listener: rejected request")
+			http.Error(w, reason, status)
+			return
+		}
+	}
+
+	if r.Method == http.MethodPost {
+		l.serveHttpSignalling(w, r, identity)
 		return
 	}
 
+	// Note: Check the suffix so that the fallback path still works when the handler is mounted under some other path
 	fallback := false
 	if r.URL != nil {
-		if r.URL.Path == "/wss" {
+		if strings.HasSuffix(r.URL.Path, "/wss") {
 			logger.Warn().Msg("Dialer requested wss fallback socket!")
 			fallback = true
 		}
 	}
 
+	subprotocols := l.subprotocols
+	if fallback {
+		subprotocols = append(slices.Clone(l.subprotocols), helloSubprotocol, fragmentSubprotocol)
+	}
+	wsConn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+		OriginPatterns: l.originPatterns,
+		Subprotocols: subprotocols,
+	})
+	if err != nil {
+		// Note: A bad upgrade request is the fault of the dialer, so it isn't returned by Accept
+		logger.Debug().
+			Err(err).
+			Str("RemoteAddr", r.RemoteAddr).
+			Msg("Listener: websocket upgrade failed")
+		return
+	}
+
 	// Build the net.Conn and push to the channel
 	if fallback {
-		ctx := context.Background() // Note: This has to be background if it is a fallback path
-		conn := websocket.NetConn(ctx, wsConn, websocket.MessageBinary)
-		conn = wsFallback{conn}
-		l.pendingAccepts <- conn
+		// Note: The fallback transport lifetime is not bound to the request, it lives until the conn is closed
+		localAddr, remoteAddr := requestAddrs(r)
+		conn := newConn(nil, localAddr, remoteAddr)
+		conn.metadata = newMetadata(r, identity)
+		fragment, hello := fallbackFeatures(wsConn.Subprotocol(), offeredSubprotocols(r))
+		conn.subprotocol = appSubprotocol(wsConn.Subprotocol())
+		conn.fragment.Store(fragment)
+		transport := newWsTransport(wsConn)
+		transport.sendsHello = hello
+		conn.setRaw(transport)
+		conn.transport = TransportWebsocket
+		l.pushAccept(conn)
 	} else {
-		// TODO: make timeout configurable?
-		ctx, _ := context.WithTimeout(context.Background(), 30 * time.Second)
-		conn := websocket.NetConn(ctx, wsConn, websocket.MessageBinary)
-		l.pendingAccepts <- conn
+		// Note: The signalling lifetime is bound by the negotiation, see Listener.attemptWebRtcNegotiation
+		localAddr, remoteAddr := requestAddrs(r)
+		signaler := newWsSignaler(context.Background(), wsConn, localAddr, remoteAddr)
+		l.pushAccept(&signalConn{signaler, signaler, newMetadata(r, identity), wsConn.Subprotocol()})
 	}
 }
 
-func (l *websocketListener) Accept() (net.Conn, error) {
+func (l *websocketListener) Accept() (io.Closer, error) {
 	select{
 	case sock := <-l.pendingAccepts:
 		return sock, nil
 	case err := <-l.pendingAcceptErrors:
 		return nil, err
+	case <-l.closeChan:
+		return nil, net.ErrClosed
 	}
 }
 func (l *websocketListener) Close() error {
-	l.closed.Store(true)
-	close(l.pendingAccepts)
-	close(l.pendingAcceptErrors)
+	var err error
+	l.closeOnce.Do(func() {
+		l.closed.Store(true)
+		close(l.closeChan)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
-	defer cancel()
-	return l.httpServer.Shutdown(ctx)
+		if l.httpServer == nil {
+			return // The server that the handler is mounted on is owned by someone else
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+		defer cancel()
+		err = l.httpServer.Shutdown(ctx)
+	})
+	return err
+}
+
+// Hands the conn to Accept. If the listener is closed, then the conn is closed instead
+func (l *websocketListener) pushAccept(conn io.Closer) {
+	select {
+	case l.pendingAccepts <- conn:
+	case <-l.closeChan:
+		conn.Close()
+	}
+}
+
+// Hands the error to Accept. If the listener is closed, then the error is dropped
+func (l *websocketListener) pushAcceptError(err error) {
+	select {
+	case l.pendingAcceptErrors <- err:
+	case <-l.closeChan:
+	}
 }
 func (l *websocketListener) Addr() net.Addr {
 	return l.addr
@@ -11,13 +11,19 @@ import (
 	"github.com/coder/websocket"
 )
 
-func dialWs(ctx context.Context, url string, tlsConfig *tls.Config) (*websocket.Conn, error) {
+func dialWs(ctx context.Context, url string, tlsConfig *tls.Config, header http.Header, subprotocols []string) (*websocket.Conn, error) {
 	wsConn, _, err := websocket.Dial(ctx, url, &websocket.DialOptions{
-		HTTPClient: &http.Client{
-			Transport: &http.Transport{
-				TLSClientConfig: tlsConfig,
-			},
-		},
+		HTTPClient: newHttpClient(tlsConfig),
+		HTTPHeader: header,
+		Subprotocols: subprotocols,
 	})
 	return wsConn, err
 }
+
+func newHttpClient(tlsConfig *tls.Config) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: tlsConfig,
+		},
+	}
+}
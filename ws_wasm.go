@@ -6,12 +6,21 @@ package rtcnet
 import (
 	"context"
 	"crypto/tls"
+	"net/http"
 
 	"github.com/coder/websocket"
 )
 
 // Note: You cant inject tlsConfig here, you are required to use the tlsConfiguration as defined by the browser.
-func dialWs(ctx context.Context, url string, tlsConfig *tls.Config) (*websocket.Conn, error) {
-	wsConn, _, err := websocket.Dial(ctx, url, nil)
+// Note: Browsers don't allow custom headers on websockets, so the header is ignored. Cookies are still sent by the browser
+func dialWs(ctx context.Context, url string, tlsConfig *tls.Config, header http.Header, subprotocols []string) (*websocket.Conn, error) {
+	wsConn, _, err := websocket.Dial(ctx, url, &websocket.DialOptions{
+		Subprotocols: subprotocols,
+	})
 	return wsConn, err
 }
+
+// Note: The browser handles TLS, so the tlsConfig is ignored
+func newHttpClient(tlsConfig *tls.Config) *http.Client {
+	return http.DefaultClient
+}